@@ -0,0 +1,250 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/proxmox"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/terraform"
+
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/loft-sh/devpod/pkg/log"
+)
+
+// Backend manages the lifecycle of the machine, either through terraform
+// or by talking to the Proxmox API directly
+type Backend interface {
+	Create(ctx context.Context) error
+	Delete(ctx context.Context) error
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Status(ctx context.Context) (client.Status, error)
+	Command(ctx context.Context, command string) error
+	Rekey(ctx context.Context) error
+	Upgrade(ctx context.Context) error
+	Console(ctx context.Context, stdin io.Reader, stdout io.Writer, cols int, rows int) error
+}
+
+// NewBackend returns the backend selected by the BACKEND option
+func NewBackend(logs log.Logger) (Backend, error) {
+	backend, err := options.GetBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	if backend == options.BACKEND_API {
+		proxmoxProvider, err := proxmox.NewProvider(logs)
+		if err != nil {
+			return nil, err
+		}
+
+		return newLockedBackend(&apiBackend{provider: proxmoxProvider}, proxmoxProvider.Config), nil
+	}
+
+	terraformProvider, err := terraform.NewProvider(logs)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLockedBackend(&terraformBackend{provider: terraformProvider}, terraformProvider.Config), nil
+}
+
+// lockedBackend runs one operation on a machine at a time, across
+// processes. Commands and the console are left out, they run for as long
+// as someone is connected, and status reports a busy machine instead of
+// waiting.
+type lockedBackend struct {
+	Backend
+	path    string
+	timeout time.Duration
+}
+
+func newLockedBackend(backend Backend, config *options.Options) *lockedBackend {
+	return &lockedBackend{
+		Backend: backend,
+		path:    filepath.Join(config.MachineFolder, lock.MachineFile),
+		timeout: config.LockTimeout,
+	}
+}
+
+func (b *lockedBackend) with(ctx context.Context, operation string, run func(ctx context.Context) error) error {
+	machineLock, err := lock.Acquire(ctx, b.path, operation, b.timeout)
+	if err != nil {
+		heldErr := &lock.HeldError{}
+		if errors.As(err, &heldErr) {
+			return fmt.Errorf("another operation is running on this machine: %w", err)
+		}
+
+		return err
+	}
+	defer machineLock.Release()
+
+	return run(lock.NewContext(ctx, machineLock))
+}
+
+func (b *lockedBackend) Create(ctx context.Context) error {
+	err := b.with(ctx, "create", func(ctx context.Context) error {
+		return b.Backend.Create(ctx)
+	})
+
+	return partialError(ctx, "create", err)
+}
+
+func (b *lockedBackend) Delete(ctx context.Context) error {
+	err := b.with(ctx, "delete", func(ctx context.Context) error {
+		return b.Backend.Delete(ctx)
+	})
+
+	return partialError(ctx, "delete", err)
+}
+
+func (b *lockedBackend) Start(ctx context.Context) error {
+	err := b.with(ctx, "start", func(ctx context.Context) error {
+		return b.Backend.Start(ctx)
+	})
+
+	return partialError(ctx, "start", err)
+}
+
+func (b *lockedBackend) Stop(ctx context.Context) error {
+	err := b.with(ctx, "stop", func(ctx context.Context) error {
+		return b.Backend.Stop(ctx)
+	})
+
+	return partialError(ctx, "stop", err)
+}
+
+func (b *lockedBackend) Rekey(ctx context.Context) error {
+	return b.with(ctx, "rekey", func(ctx context.Context) error {
+		return b.Backend.Rekey(ctx)
+	})
+}
+
+func (b *lockedBackend) Upgrade(ctx context.Context) error {
+	return b.with(ctx, "upgrade", func(ctx context.Context) error {
+		return b.Backend.Upgrade(ctx)
+	})
+}
+
+func (b *lockedBackend) Status(ctx context.Context) (client.Status, error) {
+	machineLock, err := lock.Acquire(ctx, b.path, "status", 0)
+	if err != nil {
+		heldErr := &lock.HeldError{}
+		if !errors.As(err, &heldErr) {
+			return client.StatusNotFound, err
+		}
+
+		// another status changes nothing and needn't be waited for
+		if heldErr.Holder == nil || heldErr.Holder.Operation != "status" {
+			return client.StatusBusy, nil
+		}
+
+		return b.Backend.Status(ctx)
+	}
+	defer machineLock.Release()
+
+	return b.Backend.Status(lock.NewContext(ctx, machineLock))
+}
+
+type terraformBackend struct {
+	provider *terraform.TerraformProvider
+}
+
+func (b *terraformBackend) Create(ctx context.Context) error {
+	return terraform.Create(ctx, b.provider)
+}
+
+func (b *terraformBackend) Delete(ctx context.Context) error {
+	return terraform.Delete(ctx, b.provider)
+}
+
+func (b *terraformBackend) Start(ctx context.Context) error {
+	return terraform.Start(ctx, b.provider)
+}
+
+func (b *terraformBackend) Stop(ctx context.Context) error {
+	return terraform.Stop(ctx, b.provider)
+}
+
+func (b *terraformBackend) Status(ctx context.Context) (client.Status, error) {
+	return terraform.Status(ctx, b.provider)
+}
+
+func (b *terraformBackend) Command(ctx context.Context, command string) error {
+	return terraform.Command(ctx, b.provider, command)
+}
+
+func (b *terraformBackend) Console(ctx context.Context, stdin io.Reader, stdout io.Writer, cols int, rows int) error {
+	return terraform.Console(ctx, b.provider, stdin, stdout, cols, rows)
+}
+
+func (b *terraformBackend) Rekey(ctx context.Context) error {
+	return terraform.Rekey(ctx, b.provider)
+}
+
+func (b *terraformBackend) Upgrade(ctx context.Context) error {
+	return terraform.Upgrade(ctx, b.provider)
+}
+
+type apiBackend struct {
+	provider *proxmox.ProxmoxProvider
+}
+
+func (b *apiBackend) Create(ctx context.Context) error {
+	return proxmox.Create(ctx, b.provider)
+}
+
+func (b *apiBackend) Delete(ctx context.Context) error {
+	return proxmox.Delete(ctx, b.provider)
+}
+
+func (b *apiBackend) Start(ctx context.Context) error {
+	return proxmox.Start(ctx, b.provider)
+}
+
+func (b *apiBackend) Stop(ctx context.Context) error {
+	return proxmox.Stop(ctx, b.provider)
+}
+
+func (b *apiBackend) Status(ctx context.Context) (client.Status, error) {
+	return proxmox.Status(ctx, b.provider)
+}
+
+func (b *apiBackend) Command(ctx context.Context, command string) error {
+	return proxmox.Command(ctx, b.provider, command)
+}
+
+func (b *apiBackend) Console(ctx context.Context, stdin io.Reader, stdout io.Writer, cols int, rows int) error {
+	return proxmox.Console(ctx, b.provider, stdin, stdout, cols, rows)
+}
+
+func (b *apiBackend) Rekey(ctx context.Context) error {
+	return proxmox.Rekey(ctx, b.provider)
+}
+
+func (b *apiBackend) Upgrade(ctx context.Context) error {
+	b.provider.Log.Infof("The api backend uses no terraform providers, nothing to upgrade")
+	return nil
+}
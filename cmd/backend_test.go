@@ -0,0 +1,71 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+)
+
+// runningBackend only implements status, reporting a running machine
+type runningBackend struct {
+	Backend
+}
+
+func (b *runningBackend) Status(ctx context.Context) (client.Status, error) {
+	return client.StatusRunning, nil
+}
+
+func TestLockedBackendStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lock.MachineFile)
+	backend := &lockedBackend{
+		Backend: &runningBackend{},
+		path:    path,
+		timeout: time.Minute,
+	}
+
+	status, err := backend.Status(context.Background())
+	if err != nil || status != client.StatusRunning {
+		t.Fatalf("expected a running machine, got %s, %v", status, err)
+	}
+
+	for operation, expected := range map[string]client.Status{
+		"create": client.StatusBusy,
+		"status": client.StatusRunning,
+	} {
+		held, err := lock.Acquire(context.Background(), path, operation, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		status, err := backend.Status(context.Background())
+		_ = held.Release()
+
+		if err != nil || status != expected {
+			t.Errorf("expected %s during %s, got %s, %v", expected, operation, status, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("expected status not to wait for %s, took %s", operation, time.Since(start))
+		}
+	}
+}
@@ -26,8 +26,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/pisomind/devpod-provider-proxmox/pkg/terraform"
-
 	"github.com/loft-sh/devpod/pkg/log"
 	"github.com/loft-sh/devpod/pkg/provider"
 	"github.com/spf13/cobra"
@@ -43,14 +41,20 @@ func NewCommandCmd() *cobra.Command {
 		Use:   "command",
 		Short: "Command an instance",
 		RunE: func(_ *cobra.Command, args []string) error {
-			terraformProvider, err := terraform.NewProvider(log.Default)
+			ctx, cancel, err := newContext(false)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			backend, err := NewBackend(log.Default)
 			if err != nil {
 				return err
 			}
 
 			return cmd.Run(
-				context.Background(),
-				terraformProvider,
+				ctx,
+				backend,
 				provider.FromEnvironment(),
 				log.Default,
 			)
@@ -63,7 +67,7 @@ func NewCommandCmd() *cobra.Command {
 // Run runs the command logic
 func (cmd *CommandCmd) Run(
 	ctx context.Context,
-	providerTerraform *terraform.TerraformProvider,
+	backend Backend,
 	machine *provider.Machine,
 	logs log.Logger,
 ) error {
@@ -73,5 +77,5 @@ func (cmd *CommandCmd) Run(
 		return fmt.Errorf("command environment variable is missing")
 	}
 
-	return terraform.Command(providerTerraform, command)
+	return backend.Command(ctx, command)
 }
@@ -0,0 +1,88 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/provider"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// ConsoleCmd holds the cmd flags
+type ConsoleCmd struct{}
+
+// NewConsoleCmd defines a command
+func NewConsoleCmd() *cobra.Command {
+	cmd := &ConsoleCmd{}
+	consoleCmd := &cobra.Command{
+		Use:   "console",
+		Short: "Attach to the serial console of an instance",
+		RunE: func(_ *cobra.Command, args []string) error {
+			ctx, cancel, err := newContext(false)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			backend, err := NewBackend(log.Default)
+			if err != nil {
+				return err
+			}
+
+			return cmd.Run(
+				ctx,
+				backend,
+				provider.FromEnvironment(),
+				log.Default,
+			)
+		},
+	}
+
+	return consoleCmd
+}
+
+// Run runs the command logic
+func (cmd *ConsoleCmd) Run(
+	ctx context.Context,
+	backend Backend,
+	machine *provider.Machine,
+	logs log.Logger,
+) error {
+	cols, rows := 0, 0
+
+	// keys like Ctrl-C have to reach the VM instead of ending the console
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("switch terminal to raw mode: %w", err)
+		}
+		defer func() {
+			_ = term.Restore(fd, state)
+		}()
+
+		cols, rows, _ = term.GetSize(int(os.Stdout.Fd()))
+	}
+
+	logs.Infof("Attaching to the serial console, press Ctrl-] to detach")
+	return backend.Console(ctx, os.Stdin, os.Stdout, cols, rows)
+}
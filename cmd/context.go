@@ -0,0 +1,77 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// newContext returns a context that is cancelled on interrupt or
+// termination and, with timeout, once OPERATION_TIMEOUT has passed. After
+// the first signal the default handling is restored, so a second one
+// terminates the provider right away.
+func newContext(timeout bool) (context.Context, context.CancelFunc, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if !timeout {
+		return ctx, stop, nil
+	}
+
+	operationTimeout, err := options.DurationFromEnv(options.OPERATION_TIMEOUT, options.DEFAULT_OPERATION_TIMEOUT)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, operationTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}, nil
+}
+
+// partialError explains that an operation which changes the machine was
+// cut short and may have left it half done
+func partialError(ctx context.Context, operation string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	reason := "interrupted"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = "stopped after " + options.OPERATION_TIMEOUT
+	}
+
+	return fmt.Errorf(
+		"%s was %s before it finished, the machine may be left half done, run %s again or delete the machine: %w",
+		operation,
+		reason,
+		operation,
+		err,
+	)
+}
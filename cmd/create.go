@@ -24,8 +24,6 @@ package cmd
 import (
 	"context"
 
-	"github.com/pisomind/devpod-provider-proxmox/pkg/terraform"
-
 	"github.com/loft-sh/devpod/pkg/log"
 	"github.com/loft-sh/devpod/pkg/provider"
 	"github.com/spf13/cobra"
@@ -41,14 +39,20 @@ func NewCreateCmd() *cobra.Command {
 		Use:   "create",
 		Short: "Create an instance",
 		RunE: func(_ *cobra.Command, args []string) error {
-			terraformProvider, err := terraform.NewProvider(log.Default)
+			ctx, cancel, err := newContext(true)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			backend, err := NewBackend(log.Default)
 			if err != nil {
 				return err
 			}
 
 			return cmd.Run(
-				context.Background(),
-				terraformProvider,
+				ctx,
+				backend,
 				provider.FromEnvironment(),
 				log.Default,
 			)
@@ -61,11 +65,11 @@ func NewCreateCmd() *cobra.Command {
 // Run runs the command logic
 func (cmd *CreateCmd) Run(
 	ctx context.Context,
-	providerTerraform *terraform.TerraformProvider,
+	backend Backend,
 	machine *provider.Machine,
 	logs log.Logger,
 ) error {
-	err := terraform.Create(providerTerraform)
+	err := backend.Create(ctx)
 	if err != nil {
 		return err
 	}
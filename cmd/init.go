@@ -23,11 +23,13 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/proxmox"
 	"github.com/pisomind/devpod-provider-proxmox/pkg/terraform"
 
-	"github.com/loft-sh/devpod/pkg/config"
 	"github.com/loft-sh/devpod/pkg/log"
 	"github.com/loft-sh/devpod/pkg/provider"
 	"github.com/spf13/cobra"
@@ -43,8 +45,14 @@ func NewInitCmd() *cobra.Command {
 		Use:   "init",
 		Short: "Init account",
 		RunE: func(_ *cobra.Command, args []string) error {
+			ctx, cancel, err := newContext(true)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
 			return cmd.Run(
-				context.Background(),
+				ctx,
 				provider.FromEnvironment(),
 				log.Default,
 			)
@@ -60,14 +68,17 @@ func (cmd *InitCmd) Run(
 	machine *provider.Machine,
 	logs log.Logger,
 ) error {
-	devpodPath, err := config.GetConfigDir()
+	backend, err := options.GetBackend()
 	if err != nil {
 		return err
 	}
 
-	terraformPath := devpodPath + "/bin/terraform"
+	// the api backend needs no terraform, only a working api token
+	if backend == options.BACKEND_API {
+		return checkApi(ctx, logs)
+	}
 
-	project, err := options.FromEnvOrError(options.TERRAFORM_PROJECT)
+	binary, err := terraform.BinaryFromEnv()
 	if err != nil {
 		return err
 	}
@@ -75,14 +86,45 @@ func (cmd *InitCmd) Run(
 	// create provider
 	provider := &terraform.TerraformProvider{
 		Log:     logs,
-		Bin:     terraformPath,
-		Project: project,
+		Bin:     binary.Path,
+		Binary:  binary,
+		Project: os.Getenv(options.TERRAFORM_PROJECT),
+	}
+
+	err = terraform.Install(ctx, provider)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkApi(ctx context.Context, logs log.Logger) error {
+	apiUrl, err := options.FromEnvOrError(options.PROXMOX_API_URL)
+	if err != nil {
+		return err
+	}
+
+	tokenId, err := options.FromEnvOrError(options.PROXMOX_API_TOKEN_ID)
+	if err != nil {
+		return err
+	}
+
+	tokenSecret, err := options.FromEnvOrError(options.PROXMOX_API_TOKEN_SECRET)
+	if err != nil {
+		return err
 	}
 
-	err = terraform.Install(provider)
+	insecure, err := options.BoolFromEnv(options.PROXMOX_TLS_INSECURE, false)
 	if err != nil {
 		return err
 	}
 
+	version, err := proxmox.NewClient(apiUrl, tokenId, tokenSecret, insecure).Version(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to proxmox api: %w", err)
+	}
+
+	logs.Infof("Connected to Proxmox VE %s", version)
 	return nil
 }
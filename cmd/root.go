@@ -22,10 +22,12 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"os"
 	"os/exec"
 
 	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/proxmox"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 )
@@ -56,14 +58,20 @@ func Execute() {
 	// execute command
 	err := rootCmd.Execute()
 	if err != nil {
-		if exitErr, ok := err.(*ssh.ExitError); ok {
-			os.Exit(exitErr.ExitStatus())
+		sshExitErr := &ssh.ExitError{}
+		if errors.As(err, &sshExitErr) {
+			os.Exit(sshExitErr.ExitStatus())
 		}
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if len(exitErr.Stderr) > 0 {
-				log.Default.ErrorStreamOnly().Error(string(exitErr.Stderr))
+		agentExitErr := &proxmox.AgentExitError{}
+		if errors.As(err, &agentExitErr) {
+			os.Exit(agentExitErr.ExitStatus())
+		}
+		execExitErr := &exec.ExitError{}
+		if errors.As(err, &execExitErr) {
+			if len(execExitErr.Stderr) > 0 {
+				log.Default.ErrorStreamOnly().Error(string(execExitErr.Stderr))
 			}
-			os.Exit(exitErr.ExitCode())
+			os.Exit(execExitErr.ExitCode())
 		}
 
 		log.Default.Fatal(err)
@@ -77,7 +85,12 @@ func BuildRoot() *cobra.Command {
 	rootCmd.AddCommand(NewInitCmd())
 	rootCmd.AddCommand(NewCreateCmd())
 	rootCmd.AddCommand(NewDeleteCmd())
+	rootCmd.AddCommand(NewStartCmd())
+	rootCmd.AddCommand(NewStopCmd())
 	rootCmd.AddCommand(NewCommandCmd())
 	rootCmd.AddCommand(NewStatusCmd())
+	rootCmd.AddCommand(NewUpgradeCmd())
+	rootCmd.AddCommand(NewRekeyCmd())
+	rootCmd.AddCommand(NewConsoleCmd())
 	return rootCmd
 }
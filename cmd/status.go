@@ -26,8 +26,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/pisomind/devpod-provider-proxmox/pkg/terraform"
-
 	"github.com/loft-sh/devpod/pkg/log"
 	"github.com/loft-sh/devpod/pkg/provider"
 	"github.com/spf13/cobra"
@@ -56,14 +54,20 @@ func NewStatusCmd() *cobra.Command {
 		Use:   "status",
 		Short: "Status an instance",
 		RunE: func(_ *cobra.Command, args []string) error {
-			terraformProvider, err := terraform.NewProvider(log.Default)
+			ctx, cancel, err := newContext(true)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			backend, err := NewBackend(log.Default)
 			if err != nil {
 				return err
 			}
 
 			return cmd.Run(
-				context.Background(),
-				terraformProvider,
+				ctx,
+				backend,
 				provider.FromEnvironment(),
 				log.Default,
 			)
@@ -76,11 +80,11 @@ func NewStatusCmd() *cobra.Command {
 // Run runs the command logic
 func (cmd *StatusCmd) Run(
 	ctx context.Context,
-	providerTerraform *terraform.TerraformProvider,
+	backend Backend,
 	machine *provider.Machine,
 	logs log.Logger,
 ) error {
-	status, err := terraform.Status(providerTerraform)
+	status, err := backend.Status(ctx)
 	if err != nil {
 		return err
 	}
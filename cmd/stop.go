@@ -0,0 +1,73 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/provider"
+	"github.com/spf13/cobra"
+)
+
+// StopCmd holds the cmd flags
+type StopCmd struct{}
+
+// NewStopCmd defines a command
+func NewStopCmd() *cobra.Command {
+	cmd := &StopCmd{}
+	stopCmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stop an instance",
+		RunE: func(_ *cobra.Command, args []string) error {
+			ctx, cancel, err := newContext(true)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			backend, err := NewBackend(log.Default)
+			if err != nil {
+				return err
+			}
+
+			return cmd.Run(
+				ctx,
+				backend,
+				provider.FromEnvironment(),
+				log.Default,
+			)
+		},
+	}
+
+	return stopCmd
+}
+
+// Run runs the command logic
+func (cmd *StopCmd) Run(
+	ctx context.Context,
+	backend Backend,
+	machine *provider.Machine,
+	logs log.Logger,
+) error {
+	err := backend.Stop(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
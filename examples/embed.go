@@ -0,0 +1,28 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package examples ships the example terraform projects with the binary
+package examples
+
+import "embed"
+
+// Proxmox is examples/proxmox, the default project of the terraform backend
+//
+//go:embed proxmox/*.tf
+var Proxmox embed.FS
+
+// ProxmoxDir is the directory of the project inside of Proxmox
+const ProxmoxDir = "proxmox"
@@ -27,9 +27,26 @@ terraform {
 # ==============================================================================
 
 variable "state" {
-  description = "Desired state of the VM (running, stopped, etc.)"
+  description = "Desired power state of the VM (running or stopped)"
   type        = string
   default     = "running"
+
+  validation {
+    condition     = contains(["running", "stopped"], var.state)
+    error_message = "State must be either running or stopped."
+  }
+}
+
+variable "cores" {
+  description = "Number of CPU cores of the VM"
+  type        = number
+  default     = 4
+}
+
+variable "memory" {
+  description = "Memory of the VM in MiB"
+  type        = number
+  default     = 16384
 }
 
 variable "disk_size" {
@@ -38,6 +55,29 @@ variable "disk_size" {
   default     = 100
 }
 
+variable "disk_storage" {
+  description = "Proxmox storage for the VM disk and the cloud-init drive"
+  type        = string
+  default     = "local-lvm"
+}
+
+variable "network_bridge" {
+  description = "Bridge interface on the Proxmox host the VM is attached to"
+  type        = string
+  default     = "vmbr0"
+}
+
+variable "vlan_tag" {
+  description = "VLAN tag of the VM network interface, 0 for untagged"
+  type        = number
+  default     = 0
+
+  validation {
+    condition     = var.vlan_tag >= 0 && var.vlan_tag <= 4094
+    error_message = "VLAN tag must be between 0 and 4094."
+  }
+}
+
 variable "ssh_key" {
   description = "SSH public key for user authentication"
   type        = string
@@ -66,18 +106,18 @@ variable "ci_password" {
 }
 
 variable "ci_ip" {
-  description = "Static IP address for the VM (CIDR notation, e.g., 192.168.1.100/24)"
+  description = "Static IP address for the VM (CIDR notation, e.g., 192.168.1.100/24), or dhcp"
   type        = string
   default     = "invalid"
   
   validation {
-    condition     = can(cidrhost(var.ci_ip, 0))
-    error_message = "IP address must be in valid CIDR notation (e.g., 192.168.1.100/24)."
+    condition     = var.ci_ip == "dhcp" || can(cidrhost(var.ci_ip, 0))
+    error_message = "IP address must be dhcp or in valid CIDR notation (e.g., 192.168.1.100/24)."
   }
 }
 
 variable "ci_gateway" {
-  description = "Gateway IP address for the VM network"
+  description = "Gateway IP address for the VM network, unused with dhcp"
   type        = string
   default     = "invalid"
 }
@@ -108,6 +148,12 @@ variable "pm_api_token_secret" {
   sensitive   = true
 }
 
+variable "pm_tls_insecure" {
+  description = "Skip verification of the Proxmox API certificate, e.g. for self-signed certificates"
+  type        = bool
+  default     = false
+}
+
 variable "proxmox_vm_id" {
   description = "Unique VM ID for the Proxmox virtual machine"
   type        = string
@@ -135,7 +181,7 @@ provider "proxmox" {
   pm_api_url          = var.pm_api_url
   pm_api_token_id     = var.pm_api_token_id
   pm_api_token_secret = var.pm_api_token_secret
-  pm_tls_insecure     = true  # Set to false for production with valid certificates
+  pm_tls_insecure     = var.pm_tls_insecure
   pm_debug            = false # Set to true for debugging API calls
 }
 
@@ -145,8 +191,8 @@ provider "proxmox" {
 
 # Create a Proxmox QEMU virtual machine for DevPod development
 # This resource provisions a full-featured development environment with:
-# - 4 CPU cores and 16GB RAM
-# - Configurable disk storage
+# - Configurable CPU cores and memory (4 cores and 16GB RAM by default)
+# - Configurable disk size and storage
 # - Cloud-init for automated setup
 # - Network configuration with static IP
 # - SSH key authentication
@@ -164,6 +210,9 @@ resource "proxmox_vm_qemu" "devpod" {
   # Clone from the specified Ubuntu Noble DevBox base template
   clone = var.proxmox_template_name
 
+  # Power state, driven by the provider's start and stop commands
+  vm_state = var.state
+
   # VM agent and OS configuration
   agent   = 1            # Enable QEMU agent for enhanced management
   os_type = "cloud-init" # Use cloud-init for automated configuration
@@ -171,13 +220,13 @@ resource "proxmox_vm_qemu" "devpod" {
   # CPU configuration
   # Optimized for development workloads
   cpu {
-    cores   = 4      # Number of CPU cores
-    sockets = 1      # Number of CPU sockets
+    cores   = var.cores # Number of CPU cores
+    sockets = 1         # Number of CPU sockets
     type    = "host"
   }
 
-  # Memory configuration (16GB)
-  memory = 16384
+  # Memory configuration in MiB
+  memory = var.memory
   
   # SCSI controller type for storage
   scsihw = "virtio-scsi-pci"
@@ -188,7 +237,7 @@ resource "proxmox_vm_qemu" "devpod" {
     ide {
       ide2 {
         cloudinit {
-          storage = "local-lvm"
+          storage = var.disk_storage
         }
       }
     }
@@ -197,10 +246,10 @@ resource "proxmox_vm_qemu" "devpod" {
     scsi {
       scsi0 {
         disk {
-          size      = var.disk_size # Configurable disk size
-          cache     = "writeback"   # Write cache for better performance
-          storage   = "local-lvm"   # Storage backend
-          replicate = true          # Enable replication if configured
+          size      = var.disk_size    # Configurable disk size
+          cache     = "writeback"      # Write cache for better performance
+          storage   = var.disk_storage # Storage backend
+          replicate = true             # Enable replication if configured
         }
       }
     }
@@ -214,10 +263,11 @@ resource "proxmox_vm_qemu" "devpod" {
 
   # Network interface configuration
   network {
-    id     = 0        # Network interface ID
-    model  = "virtio" # Virtio network driver for performance
-    bridge = "vmbr0"  # Bridge interface on Proxmox host
-    # tag = 256       # Uncomment to use VLAN tagging
+    id     = 0                  # Network interface ID
+    model  = "virtio"           # Virtio network driver for performance
+    bridge = var.network_bridge # Bridge interface on Proxmox host
+    # VLAN tagging, left unset for untagged traffic
+    tag = var.vlan_tag > 0 ? var.vlan_tag : null
   }
 
   # Serial console configuration
@@ -230,8 +280,9 @@ resource "proxmox_vm_qemu" "devpod" {
   boot = "order=scsi0" # Boot from SCSI disk
 
   # Network configuration via cloud-init
-  # IP address must be in CIDR notation (e.g., 192.168.1.100/24)
-  ipconfig0 = "ip=${var.ci_ip},gw=${var.ci_gateway}"
+  # IP address must be in CIDR notation (e.g., 192.168.1.100/24) or dhcp,
+  # in which case the provider discovers the address through the guest agent
+  ipconfig0 = var.ci_ip == "dhcp" ? "ip=dhcp" : "ip=${var.ci_ip},gw=${var.ci_gateway}"
 
   # SSH key configuration
   # Combines user SSH key and DevPod SSH key for access
@@ -250,6 +301,16 @@ resource "proxmox_vm_qemu" "devpod" {
 # ==============================================================================
 
 output "public_ip" {
-  description = "The public IP address of the created DevPod VM"
+  description = "The public IP address of the created DevPod VM, or dhcp"
   value       = var.ci_ip
+}
+
+output "ssh_user" {
+  description = "The user DevPod logs in to the VM as, overridden by SSH_USER"
+  value       = var.ci_user
+}
+
+output "ssh_port" {
+  description = "The port sshd of the VM listens on, overridden by SSH_PORT"
+  value       = 22
 }
\ No newline at end of file
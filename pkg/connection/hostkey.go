@@ -0,0 +1,182 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const hostKeysFile = "host_keys"
+
+// HostKeySource reads the host keys of the machine out of band, e.g.
+// through the guest agent, in authorized_keys format
+type HostKeySource func(ctx context.Context, record *Record) ([]string, error)
+
+// HostKeyError is returned when the machine presents a host key other
+// than the pinned ones, or any key while none is pinned
+type HostKeyError struct {
+	Host        string
+	Fingerprint string
+	Unpinned    bool
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Unpinned {
+		return fmt.Sprintf(
+			"no host key is pinned for %s, which presents %s. Its keys couldn't be read through the guest agent; "+
+				"run the rekey command of the provider once they can, or enable SSH_TRUST_HOST_KEY to trust the key it presents",
+			e.Host,
+			e.Fingerprint,
+		)
+	}
+
+	return fmt.Sprintf(
+		"host key %s of %s doesn't match the key pinned for this machine, someone may be impersonating it. "+
+			"If the VM was rebuilt, run the rekey command of the provider to pin its new key",
+		e.Fingerprint,
+		e.Host,
+	)
+}
+
+// LoadHostKeys returns the host keys pinned for the machine, nil if there
+// are none yet
+func LoadHostKeys(machineFolder string) ([]gossh.PublicKey, error) {
+	content, err := os.ReadFile(filepath.Join(machineFolder, hostKeysFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	keys := []gossh.PublicKey{}
+	for len(bytes.TrimSpace(content)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("parse pinned host keys: %w", err)
+		}
+
+		keys = append(keys, key)
+		content = rest
+	}
+
+	return keys, nil
+}
+
+// PinHostKeys replaces the host keys pinned for the machine
+func PinHostKeys(machineFolder string, keys []string) error {
+	lines := []string{}
+	for _, key := range keys {
+		publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return fmt.Errorf("parse host key: %w", err)
+		}
+
+		lines = append(lines, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))))
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("no host keys to pin")
+	}
+
+	return os.WriteFile(filepath.Join(machineFolder, hostKeysFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// RemoveHostKeys forgets the host keys pinned for the machine
+func RemoveHostKeys(machineFolder string) error {
+	err := os.Remove(filepath.Join(machineFolder, hostKeysFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Rekey forgets the pinned host keys of a rebuilt machine and pins the
+// keys read from source. If source has none the key the machine presents
+// is only pinned with TrustHostKey.
+func Rekey(
+	ctx context.Context,
+	machineFolder string,
+	record *Record,
+	settings *Settings,
+	source HostKeySource,
+	logs log.Logger,
+) error {
+	err := RemoveHostKeys(machineFolder)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := learnHostKeys(ctx, machineFolder, record, source, logs)
+	if err != nil || pinned {
+		return err
+	}
+
+	if !settings.TrustHostKey {
+		return fmt.Errorf(
+			"couldn't read the host keys of %s through the guest agent, enable SSH_TRUST_HOST_KEY to trust the key it presents",
+			record.Host,
+		)
+	}
+
+	logs.Debugf("Couldn't read the host keys of %s out of band", record.Host)
+	sshClient, err := Dial(ctx, machineFolder, record, settings, logs)
+	if err != nil {
+		return err
+	}
+
+	return sshClient.Close()
+}
+
+// hostKeyCallback only accepts the pinned host keys. If none are pinned
+// the key presented first is pinned with trust and refused otherwise.
+func hostKeyCallback(machineFolder string, trust bool, logs log.Logger) (gossh.HostKeyCallback, error) {
+	pinned, err := LoadHostKeys(machineFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if len(pinned) == 0 {
+			if !trust {
+				return &HostKeyError{Host: hostname, Fingerprint: gossh.FingerprintSHA256(key), Unpinned: true}
+			}
+
+			logs.Warnf("No host key pinned for %s, trusting the key %s it presents", hostname, gossh.FingerprintSHA256(key))
+			return PinHostKeys(machineFolder, []string{string(gossh.MarshalAuthorizedKey(key))})
+		}
+
+		for _, pinnedKey := range pinned {
+			if bytes.Equal(pinnedKey.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+
+		return &HostKeyError{Host: hostname, Fingerprint: gossh.FingerprintSHA256(key)}
+	}, nil
+}
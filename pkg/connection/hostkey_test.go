@@ -0,0 +1,91 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) gossh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := gossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	machineFolder := t.TempDir()
+	remote := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 22}
+	key := newHostKey(t)
+
+	// nothing pinned and nothing to trust
+	callback, err := hostKeyCallback(machineFolder, false, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeyErr := &HostKeyError{}
+	err = callback("192.168.1.10:22", remote, key)
+	if !errors.As(err, &hostKeyErr) || !hostKeyErr.Unpinned {
+		t.Fatalf("expected an unpinned host key to be refused, got %v", err)
+	}
+	pinned, err := LoadHostKeys(machineFolder)
+	if err != nil || len(pinned) != 0 {
+		t.Fatalf("expected no key to be pinned, got %v, %v", pinned, err)
+	}
+
+	// trusted on first use when asked for
+	callback, err = hostKeyCallback(machineFolder, true, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = callback("192.168.1.10:22", remote, key)
+	if err != nil {
+		t.Fatalf("expected the key to be trusted, got %v", err)
+	}
+
+	// pinned from then on, whatever the record says
+	for _, trust := range []bool{false, true} {
+		callback, err = hostKeyCallback(machineFolder, trust, log.Default)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = callback("192.168.1.10:22", remote, key)
+		if err != nil {
+			t.Errorf("expected the pinned key to be accepted, got %v", err)
+		}
+
+		err = callback("192.168.1.10:22", remote, newHostKey(t))
+		if !errors.As(err, &hostKeyErr) || hostKeyErr.Unpinned {
+			t.Errorf("expected another key to be refused, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const jumpHostKeysFile = "jump_host_keys"
+
+// Hop is a jump host the machine is reached through
+type Hop struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	User string `json:"user"`
+	// Key is the path of the private key for the hop, the DevPod key of
+	// the machine if empty
+	Key string `json:"key,omitempty"`
+}
+
+func (h Hop) address() string {
+	port := h.Port
+	if port == 0 {
+		port = 22
+	}
+
+	return net.JoinHostPort(h.Host, strconv.Itoa(port))
+}
+
+// ParseJumpHosts parses jump hosts in the notation of ProxyJump, e.g.
+// bastion.example.com or admin@bastion:2222,ssh://inner. Hops without a
+// user get defaultUser, or the local user if that is empty.
+func ParseJumpHosts(proxyJump, defaultUser, key string) ([]Hop, error) {
+	hops := []Hop{}
+	for _, entry := range strings.Split(proxyJump, ",") {
+		entry = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(entry), "ssh://"))
+		if entry == "" || entry == "none" {
+			continue
+		}
+
+		hop := Hop{User: defaultUser, Key: key, Port: 22}
+		if at := strings.LastIndex(entry, "@"); at >= 0 {
+			hop.User = entry[:at]
+			entry = entry[at+1:]
+		}
+
+		host, port, err := net.SplitHostPort(entry)
+		if err == nil {
+			hop.Port, err = strconv.Atoi(port)
+			if err != nil || hop.Port < 1 || hop.Port > 65535 {
+				return nil, fmt.Errorf("invalid port in jump host %s", entry)
+			}
+			hop.Host = host
+		} else {
+			hop.Host = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		}
+		if hop.Host == "" || strings.ContainsAny(hop.Host, "/ ") {
+			return nil, fmt.Errorf("invalid jump host %s", entry)
+		}
+
+		if hop.User == "" {
+			localUser, err := user.Current()
+			if err != nil {
+				return nil, fmt.Errorf("no user for jump host %s: %w", hop.Host, err)
+			}
+			hop.User = localUser.Username
+		}
+
+		hops = append(hops, hop)
+	}
+
+	return hops, nil
+}
+
+// jumpConn is a connection tunneled through jump hosts, closing it closes
+// the hops as well
+type jumpConn struct {
+	net.Conn
+	hops []*gossh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		_ = c.hops[i].Close()
+	}
+
+	return err
+}
+
+// dialTCP connects to address, through the jump hosts of the settings if
+// there are any
+func dialTCP(ctx context.Context, machineFolder string, settings *Settings, address string, logs log.Logger) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if len(settings.Jump) == 0 {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	hops := []*gossh.Client{}
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			_ = hops[i].Close()
+		}
+	}
+
+	for i, hop := range settings.Jump {
+		sshConfig, err := jumpConfig(machineFolder, settings.TrustHostKey, hop, logs)
+		if err != nil {
+			closeHops()
+			return nil, err
+		}
+
+		var conn net.Conn
+		if i == 0 {
+			conn, err = dialer.DialContext(ctx, "tcp", hop.address())
+		} else {
+			conn, err = hops[i-1].DialContext(ctx, "tcp", hop.address())
+		}
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("dial to jump host %s: %w", hop.address(), err)
+		}
+
+		sshConn, chans, reqs, err := clientConn(ctx, conn, hop.address(), sshConfig)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("connect to jump host %s: %w", hop.address(), err)
+		}
+
+		hops = append(hops, gossh.NewClient(sshConn, chans, reqs))
+	}
+
+	conn, err := hops[len(hops)-1].DialContext(ctx, "tcp", address)
+	if err != nil {
+		closeHops()
+		return nil, fmt.Errorf("dial to %s through jump host %s: %w", address, settings.Jump[len(settings.Jump)-1].address(), err)
+	}
+
+	return &jumpConn{Conn: conn, hops: hops}, nil
+}
+
+func jumpConfig(machineFolder string, trust bool, hop Hop, logs log.Logger) (*gossh.ClientConfig, error) {
+	privateKey, err := loadPrivateKey(machineFolder, hop.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load private key for jump host %s: %w", hop.Host, err)
+	}
+
+	sshConfig, err := ssh.ConfigFromKeyBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig.User = hop.User
+	sshConfig.HostKeyCallback, err = jumpHostKeyCallback(machineFolder, trust, logs)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig.Timeout = dialTimeout
+
+	return sshConfig, nil
+}
+
+// knownHostsFiles are where the keys of jump hosts are looked up first
+var knownHostsFiles = []string{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"}
+
+// jumpHostKeyCallback checks the key of a jump host against the
+// known_hosts files of the user and then against the keys pinned per
+// address for the machine. Jump hosts found in neither only get their key
+// trusted and pinned with trust.
+func jumpHostKeyCallback(machineFolder string, trust bool, logs log.Logger) (gossh.HostKeyCallback, error) {
+	knownHosts, err := knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(machineFolder, jumpHostKeysFile)
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if knownHosts != nil {
+			err := knownHosts(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+
+			// a known host presenting another key, or a revoked key
+			keyErr := &knownhosts.KeyError{}
+			if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+				return fmt.Errorf("jump host %s: %w", hostname, err)
+			}
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			address, pinnedKey, ok := strings.Cut(strings.TrimSpace(line), " ")
+			if !ok || address != hostname {
+				continue
+			}
+
+			publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pinnedKey))
+			if err != nil {
+				return fmt.Errorf("parse pinned key of jump host %s: %w", hostname, err)
+			}
+			if bytes.Equal(publicKey.Marshal(), key.Marshal()) {
+				return nil
+			}
+
+			return fmt.Errorf(
+				"host key %s of jump host %s doesn't match the pinned one. If it was rebuilt, remove its line from %s",
+				gossh.FingerprintSHA256(key),
+				hostname,
+				path,
+			)
+		}
+
+		if !trust {
+			return fmt.Errorf(
+				"host key %s of jump host %s is unknown, add it to ~/.ssh/known_hosts or enable SSH_TRUST_HOST_KEY to trust it",
+				gossh.FingerprintSHA256(key),
+				hostname,
+			)
+		}
+
+		logs.Warnf("No host key known for jump host %s, trusting the key %s it presents", hostname, gossh.FingerprintSHA256(key))
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.WriteString(hostname + " " + string(gossh.MarshalAuthorizedKey(key)))
+		return err
+	}, nil
+}
+
+// knownHostsCallback checks keys against those of knownHostsFiles that
+// exist, it is nil if there are none
+func knownHostsCallback() (gossh.HostKeyCallback, error) {
+	files := []string{}
+	for _, file := range knownHostsFiles {
+		path := expandHome(file)
+		_, err := os.Stat(path)
+		if err == nil {
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("read known hosts: %w", err)
+	}
+
+	return callback, nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestJumpHostKeyCallback(t *testing.T) {
+	machineFolder := t.TempDir()
+	known, other := newHostKey(t), newHostKey(t)
+
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("bastion:2222")}, known)
+	err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := knownHostsFiles
+	knownHostsFiles = []string{knownHostsFile, filepath.Join(t.TempDir(), "missing")}
+	t.Cleanup(func() {
+		knownHostsFiles = files
+	})
+
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2222}
+	callback, err := jumpHostKeyCallback(machineFolder, false, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = callback("bastion:2222", remote, known)
+	if err != nil {
+		t.Errorf("expected the key in known_hosts to be accepted, got %v", err)
+	}
+
+	err = callback("bastion:2222", remote, other)
+	if err == nil {
+		t.Errorf("expected a key other than the known one to be refused")
+	}
+
+	err = callback("inner:22", remote, other)
+	if err == nil || !strings.Contains(err.Error(), "SSH_TRUST_HOST_KEY") {
+		t.Errorf("expected an unknown jump host to be refused, got %v", err)
+	}
+
+	// with trust the key of an unknown host is pinned, not of a known one
+	callback, err = jumpHostKeyCallback(machineFolder, true, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = callback("bastion:2222", remote, other)
+	if err == nil {
+		t.Errorf("expected trust not to override known_hosts")
+	}
+
+	err = callback("inner:22", remote, other)
+	if err != nil {
+		t.Fatalf("expected the unknown jump host to be trusted, got %v", err)
+	}
+
+	callback, err = jumpHostKeyCallback(machineFolder, false, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = callback("inner:22", remote, other)
+	if err != nil {
+		t.Errorf("expected the pinned key to be accepted, got %v", err)
+	}
+
+	err = callback("inner:22", remote, known)
+	if err == nil {
+		t.Errorf("expected a key other than the pinned one to be refused")
+	}
+}
+
+// TestDialTCPJumpCancel dials through a jump host that accepts the
+// connection but never answers the handshake
+func TestDialTCPJumpCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	settings := &Settings{Jump: []Hop{{Host: "127.0.0.1", Port: port, User: "devpod", Key: keyFile}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = dialTCP(ctx, t.TempDir(), settings, "192.168.1.10:22", log.Default)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the handshake to be cancelled, got %v", err)
+	}
+	if time.Since(start) > dialTimeout {
+		t.Errorf("expected the handshake to end with the context, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ReadyPollInterval is how often the machine is probed while it boots
+var ReadyPollInterval = 3 * time.Second
+
+// HostKeyGrace is how long the host keys are read through the source
+// after SSH is reachable before giving up on them, or trusting the key
+// presented first with TrustHostKey
+var HostKeyGrace = time.Minute
+
+// dialTimeout bounds a single probe of the SSH port
+const dialTimeout = 5 * time.Second
+
+// WaitForReady waits until the stored machine accepts the key of the
+// settings over SSH and cloud-init finished, for at most timeout. The host
+// keys are pinned from hostKeys before connecting. If cloud-init failed
+// its status and the end of its output are returned in the error.
+func WaitForReady(
+	ctx context.Context,
+	machineFolder string,
+	settings *Settings,
+	timeout time.Duration,
+	hostKeys HostKeySource,
+	logs log.Logger,
+) error {
+	record, err := Load(machineFolder)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("no connection stored for the machine")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logs.Infof("Waiting for %s to accept SSH connections", record.Host)
+	sshClient, err := waitForSSH(ctx, machineFolder, record, settings, hostKeys, logs)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	logs.Infof("Waiting for cloud-init to finish")
+	statusOutput, err := output(ctx, sshClient, "cloud-init status --wait")
+	if err == nil {
+		return nil
+	}
+
+	exitErr := &gossh.ExitError{}
+	if !errors.As(err, &exitErr) {
+		if ctx.Err() != nil {
+			return fmt.Errorf("cloud-init didn't finish within %s", timeout)
+		}
+
+		return fmt.Errorf("wait for cloud-init: %w", err)
+	}
+
+	switch exitErr.ExitStatus() {
+	case 2:
+		// finished with recoverable errors
+		logs.Warnf("cloud-init finished with warnings: %s", strings.TrimSpace(statusOutput))
+		return nil
+	case 127:
+		logs.Debugf("cloud-init is not installed on the machine, not waiting for it")
+		return nil
+	}
+
+	details, _ := detailsOutput(ctx, sshClient)
+	return fmt.Errorf("cloud-init failed: %s\n%s", strings.TrimSpace(statusOutput), details)
+}
+
+func waitForSSH(
+	ctx context.Context,
+	machineFolder string,
+	record *Record,
+	settings *Settings,
+	hostKeys HostKeySource,
+	logs log.Logger,
+) (*gossh.Client, error) {
+	address := net.JoinHostPort(record.Host, strconv.Itoa(port(record)))
+
+	ticker := time.NewTicker(ReadyPollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	var reachable time.Time
+	for {
+		conn, err := dialTCP(ctx, machineFolder, settings, address, logs)
+		if err == nil {
+			_ = conn.Close()
+			if reachable.IsZero() {
+				reachable = time.Now()
+			}
+
+			var pinned bool
+			pinned, err = learnHostKeys(ctx, machineFolder, record, hostKeys, logs)
+			if err == nil && !pinned && time.Since(reachable) >= HostKeyGrace {
+				if !settings.TrustHostKey {
+					return nil, fmt.Errorf(
+						"couldn't read the host keys of %s through the guest agent within %s, enable SSH_TRUST_HOST_KEY to trust the key it presents",
+						record.Host,
+						HostKeyGrace,
+					)
+				}
+
+				logs.Debugf("Couldn't read the host keys of %s out of band", record.Host)
+				pinned = true
+			}
+
+			if pinned {
+				var sshClient *gossh.Client
+				sshClient, err = Dial(ctx, machineFolder, record, settings, logs)
+				if err == nil {
+					return sshClient, nil
+				}
+
+				hostKeyErr := &HostKeyError{}
+				if errors.As(err, &hostKeyErr) {
+					return nil, err
+				}
+			} else if err == nil {
+				err = fmt.Errorf("host keys not available yet")
+			}
+		}
+		lastErr = err
+
+		logs.Debugf("Machine not reachable over SSH yet: %v", lastErr)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("machine didn't accept SSH connections in time: %w", lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// learnHostKeys pins the host keys read from source unless keys are
+// pinned already. It reports whether the machine has pinned keys.
+func learnHostKeys(ctx context.Context, machineFolder string, record *Record, source HostKeySource, logs log.Logger) (bool, error) {
+	pinned, err := LoadHostKeys(machineFolder)
+	if err != nil {
+		return false, err
+	}
+	if len(pinned) > 0 {
+		return true, nil
+	}
+	if source == nil {
+		return false, nil
+	}
+
+	keys, err := source(ctx, record)
+	if err != nil || len(keys) == 0 {
+		logs.Debugf("Host keys not readable yet: %v", err)
+		return false, nil
+	}
+
+	err = PinHostKeys(machineFolder, keys)
+	if err != nil {
+		return false, err
+	}
+
+	pinnedKeys, err := LoadHostKeys(machineFolder)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range pinnedKeys {
+		logs.Infof("Pinned host key %s %s", key.Type(), gossh.FingerprintSHA256(key))
+	}
+
+	return true, nil
+}
+
+// output runs command and returns what it printed
+func output(ctx context.Context, sshClient *gossh.Client, command string) (string, error) {
+	buf := &bytes.Buffer{}
+	err := ssh.Run(ctx, sshClient, command, nil, buf, buf)
+	return buf.String(), err
+}
+
+// detailsOutput collects what explains a failed cloud-init run
+func detailsOutput(ctx context.Context, sshClient *gossh.Client) (string, error) {
+	return output(
+		ctx,
+		sshClient,
+		"cloud-init status --long; "+
+			"(sudo -n tail -n 40 /var/log/cloud-init-output.log || tail -n 40 /var/log/cloud-init-output.log) 2>/dev/null",
+	)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+const recordFile = "connection.json"
+
+// Record is where a machine is reached, written on create and start so
+// that commands don't need to ask terraform or the api. User is the user
+// the machine was set up with. How to log in is not recorded, see
+// Settings.
+type Record struct {
+	Host    string    `json:"host"`
+	Port    int       `json:"port"`
+	User    string    `json:"user"`
+	VmId    int       `json:"vmid"`
+	Node    string    `json:"node"`
+	Updated time.Time `json:"updated"`
+}
+
+// Settings are how to log in to a machine, read from the options on every
+// connection so that changing them applies to existing machines. User
+// takes precedence over the user of the record. Key is the path of the
+// private key to log in with, the DevPod key of the machine if empty.
+// TrustHostKey accepts the host key the machine or a jump host presents
+// if none could be pinned out of band.
+type Settings struct {
+	User         string
+	Key          string
+	Jump         []Hop
+	TrustHostKey bool
+}
+
+// SettingsFromOptions returns the settings of the SSH options
+func SettingsFromOptions(config *options.Options) (*Settings, error) {
+	jump, err := ParseJumpHosts(config.SshJumpHost, config.SshJumpUser, config.SshJumpKey)
+	if err != nil {
+		return nil, fmt.Errorf("option %s: %w", options.SSH_JUMP_HOST, err)
+	}
+
+	return &Settings{
+		User:         config.SshUser,
+		Key:          config.SshKey,
+		Jump:         jump,
+		TrustHostKey: config.SshTrustHostKey,
+	}, nil
+}
+
+func (s *Settings) user(record *Record) string {
+	if s.User != "" {
+		return s.User
+	}
+
+	return record.User
+}
+
+// Load returns the record of the machine, or nil if there is none
+func Load(machineFolder string) (*Record, error) {
+	record := &Record{}
+	err := registry.ReadJSON(filepath.Join(machineFolder, recordFile), record)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Save stores the record of the machine
+func Save(machineFolder string, record *Record) error {
+	record.Updated = time.Now()
+	return registry.WriteJSON(filepath.Join(machineFolder, recordFile), record)
+}
+
+// Remove forgets the record and the pinned host keys of the machine
+func Remove(machineFolder string) error {
+	err := os.Remove(filepath.Join(machineFolder, recordFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(machineFolder, jumpHostKeysFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return RemoveHostKeys(machineFolder)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// TestSettingsFromOptions checks that how to log in follows the options,
+// also for records written when they were stored with the record
+func TestSettingsFromOptions(t *testing.T) {
+	machineFolder := t.TempDir()
+	err := os.WriteFile(filepath.Join(machineFolder, recordFile), []byte(`{
+  "host": "192.168.1.10",
+  "port": 2222,
+  "user": "devpod",
+  "vmid": 201,
+  "node": "pve",
+  "key": "/old/id_ed25519",
+  "jump": [{"host": "old-bastion", "port": 22, "user": "admin"}],
+  "trustHostKey": true
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := Load(machineFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Host != "192.168.1.10" || record.Port != 2222 || record.User != "devpod" || record.VmId != 201 {
+		t.Fatalf("unexpected record %+v", record)
+	}
+
+	settings, err := SettingsFromOptions(&options.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.user(record) != "devpod" || settings.Key != "" || len(settings.Jump) != 0 || settings.TrustHostKey {
+		t.Errorf("expected nothing but the user to come from the record, got %+v", settings)
+	}
+
+	settings, err = SettingsFromOptions(&options.Options{
+		SshUser:         "admin",
+		SshKey:          "/new/id_ed25519",
+		SshJumpHost:     "bastion:2200",
+		SshJumpUser:     "jump",
+		SshTrustHostKey: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.user(record) != "admin" || settings.Key != "/new/id_ed25519" || !settings.TrustHostKey {
+		t.Errorf("expected the options to take precedence, got %+v", settings)
+	}
+	if len(settings.Jump) != 1 || settings.Jump[0].address() != "bastion:2200" || settings.Jump[0].User != "jump" {
+		t.Errorf("expected the jump host of the options, got %+v", settings.Jump)
+	}
+
+	_, err = SettingsFromOptions(&options.Options{SshJumpHost: "bastion:http"})
+	if err == nil {
+		t.Error("expected an invalid jump host to be refused")
+	}
+}
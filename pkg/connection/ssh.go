@@ -0,0 +1,210 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Resolver looks up how to reach the machine through terraform or the api
+type Resolver func() (*Record, error)
+
+// Command runs command on the machine over SSH, wired to the standard
+// streams of the provider. The stored record is tried first; if there is
+// none or the machine can't be reached with it, resolve is asked and the
+// record updated.
+func Command(
+	ctx context.Context,
+	machineFolder string,
+	settings *Settings,
+	resolve Resolver,
+	command string,
+	logs log.Logger,
+) error {
+	record, err := Load(machineFolder)
+	if err != nil {
+		logs.Debugf("Ignoring unreadable connection record: %v", err)
+	}
+
+	if record != nil {
+		sshClient, err := Dial(ctx, machineFolder, record, settings, logs)
+		if err == nil {
+			defer sshClient.Close()
+			return Run(ctx, sshClient, command)
+		}
+
+		// never look for the machine elsewhere when it might be spoofed
+		hostKeyErr := &HostKeyError{}
+		if stdErrors.As(err, &hostKeyErr) {
+			return err
+		}
+
+		logs.Debugf("Stored connection to %s is stale, resolving it again: %v", record.Host, err)
+	}
+
+	record, err = Refresh(machineFolder, resolve)
+	if err != nil {
+		return &UnreachableError{Err: err}
+	}
+
+	sshClient, err := Dial(ctx, machineFolder, record, settings, logs)
+	if err != nil {
+		hostKeyErr := &HostKeyError{}
+		if stdErrors.As(err, &hostKeyErr) {
+			return err
+		}
+
+		return &UnreachableError{Err: err}
+	}
+	defer sshClient.Close()
+
+	return Run(ctx, sshClient, command)
+}
+
+// UnreachableError is returned by Command when the machine couldn't be
+// reached, before the command was started
+type UnreachableError struct {
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// Refresh resolves the connection of the machine and stores it
+func Refresh(machineFolder string, resolve Resolver) (*Record, error) {
+	record, err := resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	err = Save(machineFolder, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Dial opens an SSH connection to the machine with the key of the
+// settings, only accepting its pinned host key. ctx bounds connecting, not
+// the use of the returned client.
+func Dial(ctx context.Context, machineFolder string, record *Record, settings *Settings, logs log.Logger) (*gossh.Client, error) {
+	privateKey, err := loadPrivateKey(machineFolder, settings.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load private key: %w", err)
+	}
+
+	sshConfig, err := ssh.ConfigFromKeyBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig.User = settings.user(record)
+
+	sshConfig.HostKeyCallback, err = hostKeyCallback(machineFolder, settings.TrustHostKey, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(record.Host, strconv.Itoa(port(record)))
+	conn, err := dialTCP(ctx, machineFolder, settings, address, logs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial to %s", address)
+	}
+
+	sshConn, chans, reqs, err := clientConn(ctx, conn, address, sshConfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial to %s", address)
+	}
+
+	return gossh.NewClient(sshConn, chans, reqs), nil
+}
+
+// clientConn runs the SSH handshake over conn until ctx is done. conn is
+// closed if the handshake fails.
+func clientConn(
+	ctx context.Context,
+	conn net.Conn,
+	address string,
+	sshConfig *gossh.ClientConfig,
+) (gossh.Conn, <-chan gossh.NewChannel, <-chan *gossh.Request, error) {
+	// the handshake takes no context, closing the connection ends it
+	handshake := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			cancelled <- true
+		case <-handshake:
+			cancelled <- false
+		}
+	}()
+
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, address, sshConfig)
+	close(handshake)
+	if <-cancelled {
+		if err == nil {
+			_ = sshConn.Close()
+		}
+
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+
+	return sshConn, chans, reqs, nil
+}
+
+func port(record *Record) int {
+	if record.Port == 0 {
+		return 22
+	}
+
+	return record.Port
+}
+
+// loadPrivateKey reads the private key at path, or the DevPod key of the
+// machine if path is empty
+func loadPrivateKey(machineFolder, path string) ([]byte, error) {
+	if path == "" {
+		return ssh.GetPrivateKeyRawBase(machineFolder)
+	}
+
+	return os.ReadFile(expandHome(path))
+}
+
+// Run executes command in a new session, wired to the standard streams
+func Run(ctx context.Context, sshClient *gossh.Client, command string) error {
+	return ssh.Run(ctx, sshClient, command, os.Stdin, os.Stdout, os.Stderr)
+}
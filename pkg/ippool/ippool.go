@@ -0,0 +1,357 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ippool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+const (
+	leaseFile    = "ip-lease.json"
+	registryName = "ip-leases"
+)
+
+// Pool is a set of IPv4 addresses that can be handed out to machines
+type Pool struct {
+	Prefix  int
+	ranges  []addrRange
+	exclude []addrRange
+}
+
+type addrRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return r.from.Compare(addr) <= 0 && addr.Compare(r.to) <= 0
+}
+
+// Lease is an address handed out to a machine
+type Lease struct {
+	Address   string    `json:"address"`
+	Prefix    int       `json:"prefix"`
+	MachineID string    `json:"machineId"`
+	Created   time.Time `json:"created"`
+}
+
+// CIDR returns the leased address in cidr notation as cloudinit expects it
+func (l *Lease) CIDR() string {
+	return l.Address + "/" + strconv.Itoa(l.Prefix)
+}
+
+// ParsePool parses a comma separated list of networks (192.168.1.0/24) or
+// ranges with prefix length (192.168.1.100-192.168.1.200/24), and a comma
+// separated list of addresses or ranges to leave out. The network and
+// broadcast addresses of networks and the gateway are never handed out.
+func ParsePool(pool, exclude, gateway string) (*Pool, error) {
+	retPool := &Pool{}
+
+	for _, entry := range splitList(pool) {
+		if from, to, ok := strings.Cut(entry, "-"); ok {
+			to, prefix, ok := strings.Cut(to, "/")
+			if !ok {
+				return nil, fmt.Errorf("ip pool range %s needs a prefix length, e.g. %s/24", entry, entry)
+			}
+
+			r, err := parseRange(from, to)
+			if err != nil {
+				return nil, err
+			}
+
+			bits, err := strconv.Atoi(prefix)
+			if err != nil || bits < 1 || bits > 32 {
+				return nil, fmt.Errorf("invalid prefix length in ip pool range %s", entry)
+			}
+
+			err = retPool.setPrefix(bits)
+			if err != nil {
+				return nil, err
+			}
+
+			retPool.ranges = append(retPool.ranges, r)
+			continue
+		}
+
+		network, err := netip.ParsePrefix(entry)
+		if err != nil || !network.Addr().Is4() {
+			return nil, fmt.Errorf("ip pool entry %s is neither an ipv4 network nor a range", entry)
+		}
+		network = network.Masked()
+
+		err = retPool.setPrefix(network.Bits())
+		if err != nil {
+			return nil, err
+		}
+
+		first := network.Addr()
+		last := lastAddr(network)
+		if network.Bits() < 31 {
+			// leave out network and broadcast address
+			first = first.Next()
+			last = last.Prev()
+		}
+
+		retPool.ranges = append(retPool.ranges, addrRange{from: first, to: last})
+	}
+
+	if len(retPool.ranges) == 0 {
+		return nil, fmt.Errorf("ip pool is empty")
+	}
+
+	for _, entry := range splitList(exclude) {
+		from, to, ok := strings.Cut(entry, "-")
+		if !ok {
+			to = from
+		}
+
+		r, err := parseRange(from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		retPool.exclude = append(retPool.exclude, r)
+	}
+
+	if gateway != "" {
+		r, err := parseRange(gateway, gateway)
+		if err != nil {
+			return nil, err
+		}
+
+		retPool.exclude = append(retPool.exclude, r)
+	}
+
+	return retPool, nil
+}
+
+func (p *Pool) setPrefix(bits int) error {
+	if p.Prefix != 0 && p.Prefix != bits {
+		return fmt.Errorf("all entries of the ip pool must use the same prefix length")
+	}
+
+	p.Prefix = bits
+	return nil
+}
+
+func parseRange(from, to string) (addrRange, error) {
+	fromAddr, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil || !fromAddr.Is4() {
+		return addrRange{}, fmt.Errorf("invalid ipv4 address %s", from)
+	}
+
+	toAddr, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil || !toAddr.Is4() {
+		return addrRange{}, fmt.Errorf("invalid ipv4 address %s", to)
+	}
+
+	if toAddr.Less(fromAddr) {
+		return addrRange{}, fmt.Errorf("invalid range %s-%s", from, to)
+	}
+
+	return addrRange{from: fromAddr, to: toAddr}, nil
+}
+
+func lastAddr(network netip.Prefix) netip.Addr {
+	addr := network.Addr().As4()
+	for i := network.Bits(); i < 32; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+
+	return netip.AddrFrom4(addr)
+}
+
+func splitList(list string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Next returns the first address of the pool that is neither excluded nor
+// in use
+func (p *Pool) Next(used map[netip.Addr]bool) (netip.Addr, bool) {
+	for _, r := range p.ranges {
+		for addr := r.from; addr.IsValid() && addr.Compare(r.to) <= 0; addr = addr.Next() {
+			if used[addr] || p.excluded(addr) {
+				continue
+			}
+
+			return addr, true
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+func (p *Pool) excluded(addr netip.Addr) bool {
+	for _, r := range p.exclude {
+		if r.contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve replaces the pool placeholder in config with the address leased
+// to the machine, if it already has one
+func Resolve(config *options.Options) error {
+	if config.CloudinitIp != options.CLOUDINIT_IP_POOL {
+		return nil
+	}
+
+	lease, err := LoadLease(config.MachineFolder)
+	if err != nil {
+		return err
+	}
+	if lease != nil {
+		config.CloudinitIp = lease.CIDR()
+	}
+
+	return nil
+}
+
+// Acquire leases a free address of the pool to the machine and sets it in
+// config. The addresses in use are the union of what taken reports for
+// the cluster and the leases handed out from this host; if taken fails
+// only the local leases are considered. Allocations are serialized through
+// the lease registry, so concurrent creates on one host never get the
+// same address. The address only shows up on the cluster once the VM is
+// configured, so hosts sharing a pool can race each other.
+func Acquire(ctx context.Context, config *options.Options, taken func() ([]string, error), logs log.Logger) error {
+	if config.CloudinitIp != options.CLOUDINIT_IP_POOL {
+		return nil
+	}
+
+	lease, err := LoadLease(config.MachineFolder)
+	if err != nil {
+		return err
+	}
+	if lease != nil {
+		config.CloudinitIp = lease.CIDR()
+		return nil
+	}
+
+	pool, err := ParsePool(config.IpPool, config.IpPoolExclude, config.CloudinitGateway)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Update(ctx, registryName, func(leases map[string]string) error {
+		used := map[netip.Addr]bool{}
+		for address := range leases {
+			addr, err := netip.ParseAddr(address)
+			if err == nil {
+				used[addr] = true
+			}
+		}
+
+		clusterAddresses, err := taken()
+		if err != nil {
+			logs.Warnf("Couldn't list the addresses in use on the cluster, only considering local leases: %v", err)
+		}
+		for _, address := range clusterAddresses {
+			addr, err := netip.ParseAddr(address)
+			if err == nil {
+				used[addr] = true
+			}
+		}
+
+		addr, ok := pool.Next(used)
+		if !ok {
+			return fmt.Errorf("ip pool %s is exhausted", config.IpPool)
+		}
+
+		lease = &Lease{
+			Address:   addr.String(),
+			Prefix:    pool.Prefix,
+			MachineID: config.MachineID,
+			Created:   time.Now(),
+		}
+		leases[lease.Address] = config.MachineID
+
+		return registry.WriteJSON(filepath.Join(config.MachineFolder, leaseFile), lease)
+	})
+	if err != nil {
+		return err
+	}
+
+	logs.Infof("Leased address %s from the ip pool", lease.CIDR())
+	config.CloudinitIp = lease.CIDR()
+	return nil
+}
+
+// Release returns the address leased to the machine to the pool
+func Release(ctx context.Context, config *options.Options) error {
+	if config.IpPool == "" {
+		return nil
+	}
+
+	err := registry.Update(ctx, registryName, func(leases map[string]string) error {
+		for address, machineID := range leases {
+			if machineID == config.MachineID {
+				delete(leases, address)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(config.MachineFolder, leaseFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// LoadLease returns the lease stored in the machine folder, or nil if the
+// machine has none
+func LoadLease(machineFolder string) (*Lease, error) {
+	lease := &Lease{}
+	err := registry.ReadJSON(filepath.Join(machineFolder, leaseFile), lease)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return lease, nil
+}
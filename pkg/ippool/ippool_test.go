@@ -0,0 +1,313 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ippool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// addresses returns every address the pool hands out, in order
+func addresses(pool *Pool) []string {
+	used := map[netip.Addr]bool{}
+	ret := []string{}
+	for {
+		addr, ok := pool.Next(used)
+		if !ok {
+			return ret
+		}
+
+		used[addr] = true
+		ret = append(ret, addr.String())
+	}
+}
+
+func TestParsePool(t *testing.T) {
+	for _, test := range []struct {
+		pool      string
+		exclude   string
+		gateway   string
+		prefix    int
+		addresses []string
+	}{
+		{
+			pool:      "192.168.1.0/29",
+			prefix:    29,
+			addresses: []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+		},
+		{
+			pool:      "192.168.1.5/29",
+			gateway:   "192.168.1.1",
+			prefix:    29,
+			addresses: []string{"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+		},
+		{
+			pool:      "10.0.0.0/31",
+			prefix:    31,
+			addresses: []string{"10.0.0.0", "10.0.0.1"},
+		},
+		{
+			pool:      "192.168.1.100-192.168.1.103/24",
+			prefix:    24,
+			addresses: []string{"192.168.1.100", "192.168.1.101", "192.168.1.102", "192.168.1.103"},
+		},
+		{
+			pool:      " 192.168.1.100-192.168.1.101/24, 192.168.1.200-192.168.1.201/24 ,",
+			exclude:   "192.168.1.101",
+			prefix:    24,
+			addresses: []string{"192.168.1.100", "192.168.1.200", "192.168.1.201"},
+		},
+		{
+			pool:      "192.168.1.0/28",
+			exclude:   "192.168.1.2-192.168.1.12, 192.168.1.14",
+			gateway:   "192.168.1.1",
+			prefix:    28,
+			addresses: []string{"192.168.1.13"},
+		},
+	} {
+		pool, err := ParsePool(test.pool, test.exclude, test.gateway)
+		if err != nil {
+			t.Errorf("%q: %v", test.pool, err)
+			continue
+		}
+
+		if pool.Prefix != test.prefix {
+			t.Errorf("%q: expected prefix %d, got %d", test.pool, test.prefix, pool.Prefix)
+		}
+		if got := addresses(pool); fmt.Sprint(got) != fmt.Sprint(test.addresses) {
+			t.Errorf("%q: expected %v, got %v", test.pool, test.addresses, got)
+		}
+	}
+}
+
+func TestParsePoolInvalid(t *testing.T) {
+	for _, test := range []struct {
+		pool    string
+		exclude string
+		gateway string
+	}{
+		{pool: ""},
+		{pool: " , "},
+		{pool: "192.168.1.0"},
+		{pool: "192.168.1.0/33"},
+		{pool: "fd00::/64"},
+		{pool: "192.168.1.100-192.168.1.200"},
+		{pool: "192.168.1.100-192.168.1.200/0"},
+		{pool: "192.168.1.200-192.168.1.100/24"},
+		{pool: "192.168.1.100-fd00::1/24"},
+		{pool: "192.168.1.0/24,10.0.0.0/16"},
+		{pool: "192.168.1.0/24", exclude: "192.168.1.300"},
+		{pool: "192.168.1.0/24", exclude: "192.168.1.20-192.168.1.10"},
+		{pool: "192.168.1.0/24", gateway: "gateway"},
+	} {
+		_, err := ParsePool(test.pool, test.exclude, test.gateway)
+		if err == nil {
+			t.Errorf("%q, %q, %q: expected an error", test.pool, test.exclude, test.gateway)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	pool, err := ParsePool("192.168.1.10-192.168.1.12/24", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := map[netip.Addr]bool{
+		netip.MustParseAddr("192.168.1.10"): true,
+		netip.MustParseAddr("10.0.0.1"):     true,
+	}
+	addr, ok := pool.Next(used)
+	if !ok || addr.String() != "192.168.1.11" {
+		t.Fatalf("expected 192.168.1.11, got %v, %v", addr, ok)
+	}
+
+	used[netip.MustParseAddr("192.168.1.11")] = true
+	used[netip.MustParseAddr("192.168.1.12")] = true
+	_, ok = pool.Next(used)
+	if ok {
+		t.Fatal("expected the pool to be exhausted")
+	}
+
+	// the last address of the address space doesn't wrap around
+	pool, err = ParsePool("255.255.255.254-255.255.255.255/31", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(pool); fmt.Sprint(got) != "[255.255.255.254 255.255.255.255]" {
+		t.Fatalf("expected the last two addresses, got %v", got)
+	}
+}
+
+func newPoolConfig(t *testing.T, machineID string) *options.Options {
+	return &options.Options{
+		MachineID:        machineID,
+		MachineFolder:    t.TempDir(),
+		CloudinitIp:      options.CLOUDINIT_IP_POOL,
+		CloudinitGateway: "192.168.1.1",
+		IpPool:           "192.168.1.0/24",
+		IpPoolExclude:    "192.168.1.2-192.168.1.9",
+	}
+}
+
+func noneTaken() ([]string, error) {
+	return nil, nil
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	config := newPoolConfig(t, "devpod-a")
+
+	// nothing leased yet, the placeholder stays
+	err := Resolve(config)
+	if err != nil || config.CloudinitIp != options.CLOUDINIT_IP_POOL {
+		t.Fatalf("expected the placeholder to stay, got %q, %v", config.CloudinitIp, err)
+	}
+
+	err = Acquire(context.Background(), config, noneTaken, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := newPoolConfig(t, "devpod-a")
+	resolved.MachineFolder = config.MachineFolder
+	err = Resolve(resolved)
+	if err != nil || resolved.CloudinitIp != "192.168.1.10/24" {
+		t.Fatalf("expected the leased address, got %q, %v", resolved.CloudinitIp, err)
+	}
+
+	// static addresses are left alone
+	static := &options.Options{MachineFolder: config.MachineFolder, CloudinitIp: "10.0.0.5/24"}
+	err = Resolve(static)
+	if err != nil || static.CloudinitIp != "10.0.0.5/24" {
+		t.Fatalf("expected the static address to stay, got %q, %v", static.CloudinitIp, err)
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	ctx := context.Background()
+
+	// addresses configured on the cluster are skipped
+	first := newPoolConfig(t, "devpod-a")
+	err := Acquire(ctx, first, func() ([]string, error) {
+		return []string{"192.168.1.10", "not an address"}, nil
+	}, log.Default)
+	if err != nil || first.CloudinitIp != "192.168.1.11/24" {
+		t.Fatalf("expected 192.168.1.11/24, got %q, %v", first.CloudinitIp, err)
+	}
+
+	// acquiring again keeps the lease
+	again := newPoolConfig(t, "devpod-a")
+	again.MachineFolder = first.MachineFolder
+	err = Acquire(ctx, again, noneTaken, log.Default)
+	if err != nil || again.CloudinitIp != "192.168.1.11/24" {
+		t.Fatalf("expected the lease to be kept, got %q, %v", again.CloudinitIp, err)
+	}
+
+	// local leases count even if the cluster can't be asked
+	second := newPoolConfig(t, "devpod-b")
+	err = Acquire(ctx, second, func() ([]string, error) {
+		return nil, errors.New("unreachable")
+	}, log.Default)
+	if err != nil || second.CloudinitIp != "192.168.1.10/24" {
+		t.Fatalf("expected 192.168.1.10/24, got %q, %v", second.CloudinitIp, err)
+	}
+
+	err = Release(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := LoadLease(first.MachineFolder)
+	if err != nil || lease != nil {
+		t.Fatalf("expected the lease to be removed, got %v, %v", lease, err)
+	}
+
+	// released addresses are handed out again
+	third := newPoolConfig(t, "devpod-c")
+	err = Acquire(ctx, third, noneTaken, log.Default)
+	if err != nil || third.CloudinitIp != "192.168.1.11/24" {
+		t.Fatalf("expected the released 192.168.1.11/24, got %q, %v", third.CloudinitIp, err)
+	}
+
+	// releasing twice is fine
+	err = Release(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireExhausted(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	ctx := context.Background()
+
+	first := newPoolConfig(t, "devpod-a")
+	first.IpPool = "192.168.1.10-192.168.1.10/24"
+	err := Acquire(ctx, first, noneTaken, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := newPoolConfig(t, "devpod-b")
+	second.IpPool = first.IpPool
+	err = Acquire(ctx, second, noneTaken, log.Default)
+	if err == nil {
+		t.Fatalf("expected the pool to be exhausted, got %q", second.CloudinitIp)
+	}
+	if second.CloudinitIp != options.CLOUDINIT_IP_POOL {
+		t.Fatalf("expected the placeholder to stay, got %q", second.CloudinitIp)
+	}
+}
+
+func TestAcquireConcurrent(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+
+	configs := []*options.Options{}
+	for i := 0; i < 16; i++ {
+		configs = append(configs, newPoolConfig(t, fmt.Sprintf("devpod-%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(configs))
+	for i, config := range configs {
+		wg.Add(1)
+		go func(i int, config *options.Options) {
+			defer wg.Done()
+			errs[i] = Acquire(context.Background(), config, noneTaken, log.Default)
+		}(i, config)
+	}
+	wg.Wait()
+
+	leased := map[string]string{}
+	for i, config := range configs {
+		if errs[i] != nil {
+			t.Fatalf("%s: %v", config.MachineID, errs[i])
+		}
+
+		if other, ok := leased[config.CloudinitIp]; ok {
+			t.Fatalf("%s and %s both leased %s", other, config.MachineID, config.CloudinitIp)
+		}
+		leased[config.CloudinitIp] = config.MachineID
+	}
+}
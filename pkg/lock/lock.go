@@ -0,0 +1,190 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PollInterval is how often a held lock is retried
+var PollInterval = 200 * time.Millisecond
+
+// Holder describes the process owning a lock
+type Holder struct {
+	Pid       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Operation string    `json:"operation,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// HeldError is returned when a lock could not be acquired in time
+type HeldError struct {
+	Path   string
+	Holder *Holder
+}
+
+func (e *HeldError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("lock %s is held by another process", e.Path)
+	}
+
+	operation := ""
+	if e.Holder.Operation != "" {
+		operation = " running " + e.Holder.Operation
+	}
+
+	return fmt.Sprintf(
+		"lock %s is held by pid %d on %s%s since %s",
+		e.Path,
+		e.Holder.Pid,
+		e.Holder.Host,
+		operation,
+		e.Holder.Since.Format(time.RFC3339),
+	)
+}
+
+// errLocked is returned by tryLock while another process holds the lock
+var errLocked = errors.New("locked")
+
+// Lock is an exclusive lock on a file, held through the lock of the
+// operating system, so that the lock of a process that died is released
+// with it. While the lock is held the file describes the holder. It works
+// across processes on every platform, but not across hosts unless the
+// file lives on a shared filesystem supporting locks.
+type Lock struct {
+	path string
+	file *os.File
+}
+
+// MachineFile is the lock in the folder of a machine serializing the
+// operations on it
+const MachineFile = "provider.lock"
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx recording that the caller holds l, so
+// that code it calls can tell it needn't take the lock again
+func NewContext(ctx context.Context, l *Lock) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// Held reports whether ctx records a lock on path, see NewContext
+func Held(ctx context.Context, path string) bool {
+	l, ok := ctx.Value(contextKey{}).(*Lock)
+	return ok && l.path == filepath.Clean(path)
+}
+
+// Acquire takes the lock at path, waiting up to timeout for the current
+// holder to release it or until ctx is done. With a timeout of 0 it fails
+// right away if the lock is held.
+func Acquire(ctx context.Context, path string, operation string, timeout time.Duration) (*Lock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	holder, err := json.Marshal(&Holder{
+		Pid:       os.Getpid(),
+		Host:      host,
+		Operation: operation,
+		Since:     time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = tryLock(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) {
+			_ = file.Close()
+			return nil, err
+		}
+
+		if !time.Now().Before(deadline) {
+			_ = file.Close()
+			return nil, &HeldError{Path: path, Holder: readHolder(path)}
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return nil, fmt.Errorf("wait for lock %s: %w", path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	lock := &Lock{path: filepath.Clean(path), file: file}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt(holder, 0)
+	}
+	if err != nil {
+		_ = lock.Release()
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// Release gives the lock up. The file is kept, removing it would let
+// another process lock a file that is about to vanish.
+func (l *Lock) Release() error {
+	// waiting processes must not see us as holder anymore
+	_ = l.file.Truncate(0)
+
+	err := unlock(l.file)
+	closeErr := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func readHolder(path string) *Holder {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	holder := &Holder{}
+	err = json.Unmarshal(content, holder)
+	if err != nil || holder.Pid == 0 {
+		return nil
+	}
+
+	return holder
+}
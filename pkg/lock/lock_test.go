@@ -0,0 +1,171 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lock
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary hold a lock in another process, see
+// TestAcquireDeadHolder
+func TestMain(m *testing.M) {
+	path := os.Getenv("LOCK_TEST_HOLD")
+	if path != "" {
+		_, err := Acquire(context.Background(), path, "hold", 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Println("locked")
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "machine", "provider.lock")
+
+	held, err := Acquire(context.Background(), path, "create", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(context.Background(), path, "status", 0)
+	heldErr := &HeldError{}
+	if !errors.As(err, &heldErr) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	if heldErr.Holder == nil || heldErr.Holder.Pid != os.Getpid() || heldErr.Holder.Operation != "create" {
+		t.Errorf("expected the holder to be described, got %+v", heldErr.Holder)
+	}
+
+	err = held.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held, err = Acquire(context.Background(), path, "delete", 0)
+	if err != nil {
+		t.Fatalf("expected the released lock to be free, got %v", err)
+	}
+	_ = held.Release()
+}
+
+func TestAcquireWaits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.lock")
+
+	held, err := Acquire(context.Background(), path, "create", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() {
+		_ = held.Release()
+	})
+
+	waited, err := Acquire(context.Background(), path, "start", 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the lock once released, got %v", err)
+	}
+	_ = waited.Release()
+}
+
+func TestAcquireCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.lock")
+
+	held, err := Acquire(context.Background(), path, "create", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = Acquire(ctx, path, "start", time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("expected the wait to end with the context, took %s", time.Since(start))
+	}
+}
+
+func TestAcquireDeadHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.lock")
+
+	holder := exec.Command(os.Args[0], "-test.run=^$")
+	holder.Env = append(os.Environ(), "LOCK_TEST_HOLD="+path)
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = holder.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		_ = holder.Process.Kill()
+		t.Fatalf("expected the other process to lock, got %q, %v", line, err)
+	}
+
+	_, err = Acquire(context.Background(), path, "create", 0)
+	if err == nil {
+		t.Fatal("expected the lock of the other process to be held")
+	}
+
+	// the holder dies without releasing the lock
+	_ = holder.Process.Kill()
+	_ = holder.Wait()
+
+	taken, err := Acquire(context.Background(), path, "create", 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the lock of a dead process to be free, got %v", err)
+	}
+	_ = taken.Release()
+}
+
+func TestHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), MachineFile)
+
+	held, err := Acquire(context.Background(), path, "create", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	ctx := NewContext(context.Background(), held)
+	if !Held(ctx, path) || !Held(ctx, filepath.Join(filepath.Dir(path), ".", MachineFile)) {
+		t.Error("expected the lock to be recorded in the context")
+	}
+	if Held(ctx, path+".other") || Held(context.Background(), path) {
+		t.Error("expected only the held lock to be recorded")
+	}
+}
@@ -23,33 +23,175 @@ package options
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	CLOUDINIT_SSH_KEY        = "CLOUDINIT_SSH_KEY"
-	CLOUDINIT_USERNAME       = "CLOUDINIT_USERNAME"
-	CLOUDINIT_PASSWORD       = "CLOUDINIT_PASSWORD"
-	CLOUDINIT_IP             = "CLOUDINIT_IP"
-	CLOUDINIT_GATEWAY        = "CLOUDINIT_GATEWAY"
-	NODE_NAME                = "NODE_NAME"
-	PROXMOX_API_URL          = "PROXMOX_API_URL"
-	PROXMOX_API_TOKEN_ID     = "PROXMOX_API_TOKEN_ID"
-	PROXMOX_API_TOKEN_SECRET = "PROXMOX_API_TOKEN_SECRET"
-	PROXMOX_VM_ID            = "PROXMOX_VM_ID"
-	TERRAFORM_PROJECT        = "TERRAFORM_PROJECT"
+	BACKEND                    = "BACKEND"
+	CLOUDINIT_SSH_KEY          = "CLOUDINIT_SSH_KEY"
+	COMMAND_TRANSPORT          = "COMMAND_TRANSPORT"
+	CLOUDINIT_USERNAME         = "CLOUDINIT_USERNAME"
+	CLOUDINIT_PASSWORD         = "CLOUDINIT_PASSWORD"
+	CLOUDINIT_IP               = "CLOUDINIT_IP"
+	CLOUDINIT_GATEWAY          = "CLOUDINIT_GATEWAY"
+	DISK_SIZE                  = "DISK_SIZE"
+	DISK_STORAGE               = "DISK_STORAGE"
+	IP_POOL                    = "IP_POOL"
+	IP_POOL_EXCLUDE            = "IP_POOL_EXCLUDE"
+	LOCK_TIMEOUT               = "LOCK_TIMEOUT"
+	MACHINE_TYPE               = "MACHINE_TYPE"
+	MACHINE_TYPES_FILE         = "MACHINE_TYPES_FILE"
+	NETWORK_BRIDGE             = "NETWORK_BRIDGE"
+	NETWORK_CIDR               = "NETWORK_CIDR"
+	NETWORK_INTERFACE          = "NETWORK_INTERFACE"
+	NODE_NAME                  = "NODE_NAME"
+	OPERATION_TIMEOUT          = "OPERATION_TIMEOUT"
+	PROXMOX_API_URL            = "PROXMOX_API_URL"
+	PROXMOX_API_TOKEN_ID       = "PROXMOX_API_TOKEN_ID"
+	PROXMOX_API_TOKEN_SECRET   = "PROXMOX_API_TOKEN_SECRET"
+	PROXMOX_TLS_INSECURE       = "PROXMOX_TLS_INSECURE"
+	PROXMOX_VM_ID              = "PROXMOX_VM_ID"
+	READY_TIMEOUT              = "READY_TIMEOUT"
+	RETRY_ATTEMPTS             = "RETRY_ATTEMPTS"
+	RETRY_TIMEOUT              = "RETRY_TIMEOUT"
+	SSH_JUMP_HOST              = "SSH_JUMP_HOST"
+	SSH_JUMP_KEY               = "SSH_JUMP_KEY"
+	SSH_JUMP_USER              = "SSH_JUMP_USER"
+	SSH_KEY                    = "SSH_KEY"
+	SSH_PORT                   = "SSH_PORT"
+	SSH_TRUST_HOST_KEY         = "SSH_TRUST_HOST_KEY"
+	SSH_USER                   = "SSH_USER"
+	TEMPLATE_NAME              = "TEMPLATE_NAME"
+	TERRAFORM_ARCHIVE          = "TERRAFORM_ARCHIVE"
+	TERRAFORM_ARCHIVE_SHA256   = "TERRAFORM_ARCHIVE_SHA256"
+	TERRAFORM_BACKEND          = "TERRAFORM_BACKEND"
+	TERRAFORM_BACKEND_ADDRESS  = "TERRAFORM_BACKEND_ADDRESS"
+	TERRAFORM_BACKEND_BUCKET   = "TERRAFORM_BACKEND_BUCKET"
+	TERRAFORM_BACKEND_PASSWORD = "TERRAFORM_BACKEND_PASSWORD"
+	TERRAFORM_BACKEND_PREFIX   = "TERRAFORM_BACKEND_PREFIX"
+	TERRAFORM_BACKEND_REGION   = "TERRAFORM_BACKEND_REGION"
+	TERRAFORM_BACKEND_USERNAME = "TERRAFORM_BACKEND_USERNAME"
+	TERRAFORM_BIN              = "TERRAFORM_BIN"
+	TERRAFORM_ENGINE           = "TERRAFORM_ENGINE"
+	TERRAFORM_PROJECT          = "TERRAFORM_PROJECT"
+	TERRAFORM_PROJECT_UPDATE   = "TERRAFORM_PROJECT_UPDATE"
+	TERRAFORM_PROVIDER_MIRROR  = "TERRAFORM_PROVIDER_MIRROR"
+	TERRAFORM_UPGRADE          = "TERRAFORM_UPGRADE"
+	TERRAFORM_VERSION          = "TERRAFORM_VERSION"
+	VLAN_TAG                   = "VLAN_TAG"
+	VM_CORES                   = "VM_CORES"
+	VM_MEMORY                  = "VM_MEMORY"
+	VMID_RANGE                 = "VMID_RANGE"
+)
+
+// Defaults for the size of the VM, in line with examples/proxmox
+const (
+	DEFAULT_VM_CORES       = "4"
+	DEFAULT_VM_MEMORY      = "16384"
+	DEFAULT_DISK_SIZE      = "100"
+	DEFAULT_DISK_STORAGE   = "local-lvm"
+	DEFAULT_NETWORK_BRIDGE = "vmbr0"
+	DEFAULT_TEMPLATE_NAME  = "ubuntu-noble-devbox-base"
+)
+
+// DEFAULT_LOCK_TIMEOUT is how long to wait for another operation on the
+// same machine to finish
+const DEFAULT_LOCK_TIMEOUT = 5 * time.Minute
+
+// DEFAULT_OPERATION_TIMEOUT is how long create, delete, start, stop and
+// status may take
+const DEFAULT_OPERATION_TIMEOUT = 30 * time.Minute
+
+// DEFAULT_READY_TIMEOUT is how long create waits for SSH and cloud-init
+const DEFAULT_READY_TIMEOUT = 10 * time.Minute
+
+// DEFAULT_RETRY_ATTEMPTS is how often a Proxmox API request or terraform
+// run is tried when it fails with a transient error
+const DEFAULT_RETRY_ATTEMPTS = "5"
+
+// DEFAULT_RETRY_TIMEOUT is how long after the first attempt retries may
+// still start
+const DEFAULT_RETRY_TIMEOUT = 10 * time.Minute
+
+// CLOUDINIT_IP_DHCP as CLOUDINIT_IP lets the VM get its address through
+// DHCP, which is then discovered through the QEMU guest agent
+const CLOUDINIT_IP_DHCP = "dhcp"
+
+// CLOUDINIT_IP_POOL as CLOUDINIT_IP leases a free static address from
+// IP_POOL to the machine
+const CLOUDINIT_IP_POOL = "pool"
+
+// PROXMOX_VM_ID_AUTO as PROXMOX_VM_ID allocates a free VMID on create
+const PROXMOX_VM_ID_AUTO = "auto"
+
+// Engines that can apply the terraform project, with the version installed
+// if TERRAFORM_VERSION is unset
+const (
+	TERRAFORM_ENGINE_TERRAFORM = "terraform"
+	TERRAFORM_ENGINE_TOFU      = "tofu"
+
+	DEFAULT_TERRAFORM_VERSION = "1.4.0"
+	DEFAULT_TOFU_VERSION      = "1.6.2"
+)
+
+// Terraform backends the state of machines can be kept in, local keeps
+// it in the machine folder
+const (
+	TERRAFORM_BACKEND_LOCAL  = "local"
+	TERRAFORM_BACKEND_HTTP   = "http"
+	TERRAFORM_BACKEND_S3     = "s3"
+	TERRAFORM_BACKEND_PG     = "pg"
+	TERRAFORM_BACKEND_CONSUL = "consul"
+
+	DEFAULT_TERRAFORM_BACKEND_PREFIX = "devpod-proxmox"
+	DEFAULT_TERRAFORM_BACKEND_REGION = "us-east-1"
+)
+
+// Transports commands reach the machine through. guest-agent runs them
+// through the QEMU guest agent via the Proxmox API, which can't stream
+// stdio, auto only when SSH is unreachable and nothing is piped to them.
+const (
+	COMMAND_TRANSPORT_SSH         = "ssh"
+	COMMAND_TRANSPORT_GUEST_AGENT = "guest-agent"
+	COMMAND_TRANSPORT_AUTO        = "auto"
+)
+
+// Backends that can manage the lifecycle of the VM
+const (
+	BACKEND_TERRAFORM = "terraform"
+	BACKEND_API       = "api"
 )
 
 type Options struct {
 	MachineID     string
 	MachineFolder string
+	Backend       string
+	LockTimeout   time.Duration
+	RetryAttempts int
+	RetryTimeout  time.Duration
 
 	// Proxmox
 	NodeName              string
 	ProxmoxApiUrl         string
 	ProxmoxApiTokenId     string
 	ProxmoxApiTokenSecret string
+	ProxmoxTlsInsecure    bool
 	ProxmoxVmId           string
+	VmIdRange             string
+	TemplateName          string
+
+	// Sizing
+	MachineType   string
+	VmCores       string
+	VmMemory      string
+	DiskSize      string
+	DiskStorage   string
+	NetworkBridge string
+	VlanTag       string
 
 	// Cloudinit
 	CloudinitSshKey   string
@@ -57,20 +199,85 @@ type Options struct {
 	CloudinitPassword string
 	CloudinitIp       string
 	CloudinitGateway  string
+
+	// Address discovery
+	NetworkInterface string
+	NetworkCidr      string
+	ReadyTimeout     time.Duration
+
+	// SSH
+	CommandTransport string
+	SshUser          string
+	SshPort          int
+	SshKey           string
+	SshJumpHost      string
+	SshJumpUser      string
+	SshJumpKey       string
+	SshTrustHostKey  bool
+
+	// Address allocation
+	IpPool        string
+	IpPoolExclude string
+
+	// Terraform
+	TerraformUpgrade       bool
+	TerraformProjectUpdate bool
+
+	// Terraform state
+	TerraformBackend         string
+	TerraformBackendAddress  string
+	TerraformBackendBucket   string
+	TerraformBackendRegion   string
+	TerraformBackendPrefix   string
+	TerraformBackendUsername string
+	TerraformBackendPassword string
+	TerraformProviderMirror  string
 }
 
 func ConfigFromEnv() (Options, error) {
 	return Options{
-		NodeName:              os.Getenv(NODE_NAME),
-		ProxmoxApiUrl:         os.Getenv(PROXMOX_API_URL),
-		ProxmoxApiTokenId:     os.Getenv(PROXMOX_API_TOKEN_ID),
-		ProxmoxApiTokenSecret: os.Getenv(PROXMOX_API_TOKEN_SECRET),
-		ProxmoxVmId:           os.Getenv(PROXMOX_VM_ID),
-		CloudinitSshKey:       os.Getenv(CLOUDINIT_SSH_KEY),
-		CloudinitUsername:     os.Getenv(CLOUDINIT_USERNAME),
-		CloudinitPassword:     os.Getenv(CLOUDINIT_PASSWORD),
-		CloudinitIp:           os.Getenv(CLOUDINIT_IP),
-		CloudinitGateway:      os.Getenv(CLOUDINIT_GATEWAY),
+		Backend:                  os.Getenv(BACKEND),
+		NodeName:                 os.Getenv(NODE_NAME),
+		ProxmoxApiUrl:            os.Getenv(PROXMOX_API_URL),
+		ProxmoxApiTokenId:        os.Getenv(PROXMOX_API_TOKEN_ID),
+		ProxmoxApiTokenSecret:    os.Getenv(PROXMOX_API_TOKEN_SECRET),
+		ProxmoxTlsInsecure:       os.Getenv(PROXMOX_TLS_INSECURE) == "true",
+		ProxmoxVmId:              os.Getenv(PROXMOX_VM_ID),
+		VmIdRange:                os.Getenv(VMID_RANGE),
+		TemplateName:             os.Getenv(TEMPLATE_NAME),
+		MachineType:              os.Getenv(MACHINE_TYPE),
+		VmCores:                  os.Getenv(VM_CORES),
+		VmMemory:                 os.Getenv(VM_MEMORY),
+		DiskSize:                 os.Getenv(DISK_SIZE),
+		DiskStorage:              os.Getenv(DISK_STORAGE),
+		NetworkBridge:            os.Getenv(NETWORK_BRIDGE),
+		VlanTag:                  os.Getenv(VLAN_TAG),
+		CloudinitSshKey:          os.Getenv(CLOUDINIT_SSH_KEY),
+		CloudinitUsername:        os.Getenv(CLOUDINIT_USERNAME),
+		CloudinitPassword:        os.Getenv(CLOUDINIT_PASSWORD),
+		CloudinitIp:              os.Getenv(CLOUDINIT_IP),
+		CloudinitGateway:         os.Getenv(CLOUDINIT_GATEWAY),
+		NetworkInterface:         os.Getenv(NETWORK_INTERFACE),
+		NetworkCidr:              os.Getenv(NETWORK_CIDR),
+		CommandTransport:         os.Getenv(COMMAND_TRANSPORT),
+		SshUser:                  os.Getenv(SSH_USER),
+		SshKey:                   os.Getenv(SSH_KEY),
+		SshJumpHost:              os.Getenv(SSH_JUMP_HOST),
+		SshJumpUser:              os.Getenv(SSH_JUMP_USER),
+		SshJumpKey:               os.Getenv(SSH_JUMP_KEY),
+		SshTrustHostKey:          os.Getenv(SSH_TRUST_HOST_KEY) == "true",
+		IpPool:                   os.Getenv(IP_POOL),
+		IpPoolExclude:            os.Getenv(IP_POOL_EXCLUDE),
+		TerraformUpgrade:         os.Getenv(TERRAFORM_UPGRADE) == "true",
+		TerraformProjectUpdate:   os.Getenv(TERRAFORM_PROJECT_UPDATE) == "true",
+		TerraformProviderMirror:  os.Getenv(TERRAFORM_PROVIDER_MIRROR),
+		TerraformBackend:         os.Getenv(TERRAFORM_BACKEND),
+		TerraformBackendAddress:  os.Getenv(TERRAFORM_BACKEND_ADDRESS),
+		TerraformBackendBucket:   os.Getenv(TERRAFORM_BACKEND_BUCKET),
+		TerraformBackendRegion:   os.Getenv(TERRAFORM_BACKEND_REGION),
+		TerraformBackendPrefix:   os.Getenv(TERRAFORM_BACKEND_PREFIX),
+		TerraformBackendUsername: os.Getenv(TERRAFORM_BACKEND_USERNAME),
+		TerraformBackendPassword: os.Getenv(TERRAFORM_BACKEND_PASSWORD),
 	}, nil
 }
 
@@ -91,6 +298,27 @@ func FromEnv() (*Options, error) {
 	// prefix with devpod-
 	retOptions.MachineID = "devpod-" + retOptions.MachineID
 
+	retOptions.Backend, err = GetBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.LockTimeout, err = DurationFromEnv(LOCK_TIMEOUT, DEFAULT_LOCK_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	retryAttempts, err := PositiveIntFromEnv(RETRY_ATTEMPTS, DEFAULT_RETRY_ATTEMPTS)
+	if err != nil {
+		return nil, err
+	}
+	retOptions.RetryAttempts, _ = strconv.Atoi(retryAttempts)
+
+	retOptions.RetryTimeout, err = DurationFromEnv(RETRY_TIMEOUT, DEFAULT_RETRY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
 	retOptions.NodeName, err = FromEnvOrError(NODE_NAME)
 	if err != nil {
 		return nil, err
@@ -111,11 +339,54 @@ func FromEnv() (*Options, error) {
 		return nil, err
 	}
 
+	retOptions.ProxmoxTlsInsecure, err = BoolFromEnv(PROXMOX_TLS_INSECURE, false)
+	if err != nil {
+		return nil, err
+	}
+
 	retOptions.ProxmoxVmId, err = FromEnvOrError(PROXMOX_VM_ID)
 	if err != nil {
 		return nil, err
 	}
 
+	retOptions.VmIdRange = os.Getenv(VMID_RANGE)
+
+	retOptions.TemplateName = FromEnvOrDefault(TEMPLATE_NAME, DEFAULT_TEMPLATE_NAME)
+
+	// explicitly set sizes take precedence over the machine type
+	retOptions.MachineType = os.Getenv(MACHINE_TYPE)
+	machineType, err := GetMachineType(retOptions.MachineType, os.Getenv(MACHINE_TYPES_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.VmCores, err = PositiveIntFromEnv(VM_CORES, strconv.Itoa(machineType.Cores))
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.VmMemory, err = PositiveIntFromEnv(VM_MEMORY, strconv.Itoa(machineType.Memory))
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.DiskSize, err = PositiveIntFromEnv(DISK_SIZE, strconv.Itoa(machineType.DiskSize))
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.DiskStorage = FromEnvOrDefault(DISK_STORAGE, DEFAULT_DISK_STORAGE)
+
+	retOptions.NetworkBridge = FromEnvOrDefault(NETWORK_BRIDGE, DEFAULT_NETWORK_BRIDGE)
+
+	retOptions.VlanTag = os.Getenv(VLAN_TAG)
+	if retOptions.VlanTag != "" {
+		tag, err := strconv.Atoi(retOptions.VlanTag)
+		if err != nil || tag < 1 || tag > 4094 {
+			return nil, fmt.Errorf("option %s must be a vlan id between 1 and 4094, got %s", VLAN_TAG, retOptions.VlanTag)
+		}
+	}
+
 	retOptions.CloudinitSshKey, err = FromEnvOrError(CLOUDINIT_SSH_KEY)
 	if err != nil {
 		return nil, err
@@ -136,11 +407,116 @@ func FromEnv() (*Options, error) {
 		return nil, err
 	}
 
-	retOptions.CloudinitGateway, err = FromEnvOrError(CLOUDINIT_GATEWAY)
+	// with dhcp the gateway is handed out by the dhcp server
+	if retOptions.CloudinitIp == CLOUDINIT_IP_DHCP {
+		retOptions.CloudinitGateway = os.Getenv(CLOUDINIT_GATEWAY)
+	} else {
+		retOptions.CloudinitGateway, err = FromEnvOrError(CLOUDINIT_GATEWAY)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if retOptions.CloudinitIp == CLOUDINIT_IP_POOL {
+		retOptions.IpPool, err = FromEnvOrError(IP_POOL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		retOptions.IpPool = os.Getenv(IP_POOL)
+	}
+
+	retOptions.IpPoolExclude = os.Getenv(IP_POOL_EXCLUDE)
+
+	retOptions.NetworkInterface = os.Getenv(NETWORK_INTERFACE)
+
+	retOptions.ReadyTimeout, err = DurationFromEnv(READY_TIMEOUT, DEFAULT_READY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.NetworkCidr = os.Getenv(NETWORK_CIDR)
+	if retOptions.NetworkCidr != "" {
+		_, _, err = net.ParseCIDR(retOptions.NetworkCidr)
+		if err != nil {
+			return nil, fmt.Errorf("option %s must be in cidr notation: %w", NETWORK_CIDR, err)
+		}
+	}
+
+	retOptions.CommandTransport = FromEnvOrDefault(COMMAND_TRANSPORT, COMMAND_TRANSPORT_SSH)
+	switch retOptions.CommandTransport {
+	case COMMAND_TRANSPORT_SSH, COMMAND_TRANSPORT_GUEST_AGENT, COMMAND_TRANSPORT_AUTO:
+	default:
+		return nil, fmt.Errorf(
+			"unknown command transport %s, %s must be one of ssh, guest-agent or auto",
+			retOptions.CommandTransport,
+			COMMAND_TRANSPORT,
+		)
+	}
+
+	retOptions.SshUser = os.Getenv(SSH_USER)
+	retOptions.SshKey = os.Getenv(SSH_KEY)
+
+	if os.Getenv(SSH_PORT) != "" {
+		retOptions.SshPort, err = strconv.Atoi(os.Getenv(SSH_PORT))
+		if err != nil || retOptions.SshPort < 1 || retOptions.SshPort > 65535 {
+			return nil, fmt.Errorf("option %s must be a port number, got %s", SSH_PORT, os.Getenv(SSH_PORT))
+		}
+	}
+
+	retOptions.SshJumpHost = os.Getenv(SSH_JUMP_HOST)
+	retOptions.SshJumpUser = os.Getenv(SSH_JUMP_USER)
+	retOptions.SshJumpKey = os.Getenv(SSH_JUMP_KEY)
+
+	retOptions.SshTrustHostKey, err = BoolFromEnv(SSH_TRUST_HOST_KEY, false)
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.TerraformUpgrade, err = BoolFromEnv(TERRAFORM_UPGRADE, false)
+	if err != nil {
+		return nil, err
+	}
+
+	retOptions.TerraformProjectUpdate, err = BoolFromEnv(TERRAFORM_PROJECT_UPDATE, false)
 	if err != nil {
 		return nil, err
 	}
 
+	retOptions.TerraformProviderMirror = os.Getenv(TERRAFORM_PROVIDER_MIRROR)
+	if strings.HasPrefix(retOptions.TerraformProviderMirror, "http://") {
+		return nil, fmt.Errorf("option %s must use https, terraform doesn't accept plain http mirrors", TERRAFORM_PROVIDER_MIRROR)
+	}
+
+	retOptions.TerraformBackend = FromEnvOrDefault(TERRAFORM_BACKEND, TERRAFORM_BACKEND_LOCAL)
+	retOptions.TerraformBackendAddress = os.Getenv(TERRAFORM_BACKEND_ADDRESS)
+	retOptions.TerraformBackendBucket = os.Getenv(TERRAFORM_BACKEND_BUCKET)
+	retOptions.TerraformBackendRegion = FromEnvOrDefault(TERRAFORM_BACKEND_REGION, DEFAULT_TERRAFORM_BACKEND_REGION)
+	retOptions.TerraformBackendPrefix = FromEnvOrDefault(TERRAFORM_BACKEND_PREFIX, DEFAULT_TERRAFORM_BACKEND_PREFIX)
+	retOptions.TerraformBackendUsername = os.Getenv(TERRAFORM_BACKEND_USERNAME)
+	retOptions.TerraformBackendPassword = os.Getenv(TERRAFORM_BACKEND_PASSWORD)
+	switch retOptions.TerraformBackend {
+	case TERRAFORM_BACKEND_LOCAL:
+	case TERRAFORM_BACKEND_S3:
+		if retOptions.TerraformBackendBucket == "" {
+			return nil, fmt.Errorf("option %s is required with the s3 backend", TERRAFORM_BACKEND_BUCKET)
+		}
+	case TERRAFORM_BACKEND_HTTP, TERRAFORM_BACKEND_PG, TERRAFORM_BACKEND_CONSUL:
+		if retOptions.TerraformBackendAddress == "" {
+			return nil, fmt.Errorf(
+				"option %s is required with the %s backend",
+				TERRAFORM_BACKEND_ADDRESS,
+				retOptions.TerraformBackend,
+			)
+		}
+	default:
+		return nil, fmt.Errorf(
+			"unknown terraform backend %s, %s must be one of local, http, s3, pg or consul",
+			retOptions.TerraformBackend,
+			TERRAFORM_BACKEND,
+		)
+	}
+
 	return retOptions, nil
 }
 
@@ -156,3 +532,91 @@ func FromEnvOrError(name string) (string, error) {
 
 	return val, nil
 }
+
+// GetTerraformEngine returns the configured engine, defaulting to terraform
+func GetTerraformEngine() (string, error) {
+	engine := os.Getenv(TERRAFORM_ENGINE)
+	switch engine {
+	case "":
+		return TERRAFORM_ENGINE_TERRAFORM, nil
+	case TERRAFORM_ENGINE_TERRAFORM, TERRAFORM_ENGINE_TOFU:
+		return engine, nil
+	}
+
+	return "", fmt.Errorf(
+		"unknown engine %s, %s must be one of %s or %s",
+		engine,
+		TERRAFORM_ENGINE,
+		TERRAFORM_ENGINE_TERRAFORM,
+		TERRAFORM_ENGINE_TOFU,
+	)
+}
+
+// GetBackend returns the configured backend, defaulting to terraform
+func GetBackend() (string, error) {
+	backend := os.Getenv(BACKEND)
+	switch backend {
+	case "":
+		return BACKEND_TERRAFORM, nil
+	case BACKEND_TERRAFORM, BACKEND_API:
+		return backend, nil
+	}
+
+	return "", fmt.Errorf(
+		"unknown backend %s, %s must be one of %s or %s",
+		backend,
+		BACKEND,
+		BACKEND_TERRAFORM,
+		BACKEND_API,
+	)
+}
+
+func FromEnvOrDefault(name string, defaultValue string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultValue
+	}
+
+	return val
+}
+
+func PositiveIntFromEnv(name string, defaultValue string) (string, error) {
+	val := FromEnvOrDefault(name, defaultValue)
+
+	number, err := strconv.Atoi(val)
+	if err != nil || number <= 0 {
+		return "", fmt.Errorf("option %s must be a positive number, got %s", name, val)
+	}
+
+	return val, nil
+}
+
+// DurationFromEnv parses a duration like 90s or 5m, falling back to
+// defaultValue if it is unset
+func DurationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+
+	ret, err := time.ParseDuration(val)
+	if err != nil || ret <= 0 {
+		return 0, fmt.Errorf("option %s must be a positive duration like 90s or 5m", name)
+	}
+
+	return ret, nil
+}
+
+func BoolFromEnv(name string, defaultValue bool) (bool, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+
+	ret, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("option %s must be true or false, got %s", name, val)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"testing"
+)
+
+// setRequiredEnv sets the options FromEnv can't do without
+func setRequiredEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"MACHINE_FOLDER":         t.TempDir(),
+		"MACHINE_ID":             "test",
+		NODE_NAME:                "pve",
+		PROXMOX_API_URL:          "https://pve.example.com:8006/api2/json",
+		PROXMOX_API_TOKEN_ID:     "devpod@pve!token",
+		PROXMOX_API_TOKEN_SECRET: "secret",
+		PROXMOX_VM_ID:            "9000",
+		CLOUDINIT_SSH_KEY:        "ssh-ed25519 AAAA",
+		CLOUDINIT_USERNAME:       "devpod",
+		CLOUDINIT_PASSWORD:       "devpod",
+		CLOUDINIT_IP:             CLOUDINIT_IP_DHCP,
+	} {
+		t.Setenv(name, value)
+	}
+}
+
+func TestProxmoxTlsInsecure(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected bool
+		fails    bool
+	}{
+		{value: "", expected: false},
+		{value: "false", expected: false},
+		{value: "true", expected: true},
+		{value: "yes", fails: true},
+	} {
+		setRequiredEnv(t)
+		t.Setenv(PROXMOX_TLS_INSECURE, test.value)
+
+		config, err := FromEnv()
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.value, err)
+		}
+		if config.ProxmoxTlsInsecure != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.value, test.expected, config.ProxmoxTlsInsecure)
+		}
+
+		lenient, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lenient.ProxmoxTlsInsecure != test.expected {
+			t.Errorf("%q: expected %v from ConfigFromEnv, got %v", test.value, test.expected, lenient.ProxmoxTlsInsecure)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// MACHINE_TYPE_CUSTOM leaves the size of the VM to VM_CORES, VM_MEMORY and
+// DISK_SIZE alone
+const MACHINE_TYPE_CUSTOM = "custom"
+
+// MachineType is a named VM size. Memory is in MiB, DiskSize in GB.
+type MachineType struct {
+	Cores    int `json:"cores"`
+	Memory   int `json:"memory"`
+	DiskSize int `json:"diskSize"`
+}
+
+// MachineTypes are the built-in sizes, a MACHINE_TYPES_FILE can add to and
+// override them
+var MachineTypes = map[string]MachineType{
+	"small":  {Cores: 2, Memory: 4096, DiskSize: 40},
+	"medium": {Cores: 4, Memory: 16384, DiskSize: 100},
+	"large":  {Cores: 8, Memory: 32768, DiskSize: 200},
+}
+
+// GetMachineType resolves name against the built-in machine types and the
+// ones defined in file, a YAML or JSON map of names to machine types. For
+// custom or an empty name the defaults are returned.
+func GetMachineType(name, file string) (MachineType, error) {
+	machineTypes := map[string]MachineType{}
+	for key, value := range MachineTypes {
+		machineTypes[key] = value
+	}
+
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return MachineType{}, fmt.Errorf("read %s: %w", MACHINE_TYPES_FILE, err)
+		}
+
+		fileTypes := map[string]MachineType{}
+		err = yaml.Unmarshal(content, &fileTypes)
+		if err != nil {
+			return MachineType{}, fmt.Errorf("parse %s: %w", file, err)
+		}
+
+		for key, value := range fileTypes {
+			if value.Cores <= 0 || value.Memory <= 0 || value.DiskSize <= 0 {
+				return MachineType{}, fmt.Errorf("machine type %s in %s needs positive cores, memory and diskSize", key, file)
+			}
+
+			machineTypes[key] = value
+		}
+	}
+
+	if name == "" || name == MACHINE_TYPE_CUSTOM {
+		return defaultMachineType(), nil
+	}
+
+	machineType, ok := machineTypes[name]
+	if !ok {
+		names := []string{MACHINE_TYPE_CUSTOM}
+		for key := range machineTypes {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+
+		return MachineType{}, fmt.Errorf(
+			"unknown machine type %s, %s must be one of %s",
+			name,
+			MACHINE_TYPE,
+			strings.Join(names, ", "),
+		)
+	}
+
+	return machineType, nil
+}
+
+func defaultMachineType() MachineType {
+	cores, _ := strconv.Atoi(DEFAULT_VM_CORES)
+	memory, _ := strconv.Atoi(DEFAULT_VM_MEMORY)
+	diskSize, _ := strconv.Atoi(DEFAULT_DISK_SIZE)
+
+	return MachineType{Cores: cores, Memory: memory, DiskSize: diskSize}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMachineTypes writes content into a machine types file named name
+func writeMachineTypes(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestGetMachineType(t *testing.T) {
+	yamlFile := writeMachineTypes(t, "types.yaml", `
+gpu:
+  cores: 16
+  memory: 65536
+  diskSize: 500
+small:
+  cores: 1
+  memory: 2048
+  diskSize: 20
+`)
+	jsonFile := writeMachineTypes(t, "types.json", `{"tiny": {"cores": 1, "memory": 1024, "diskSize": 10}}`)
+
+	for _, test := range []struct {
+		name     string
+		file     string
+		expected MachineType
+	}{
+		{name: "", expected: MachineType{Cores: 4, Memory: 16384, DiskSize: 100}},
+		{name: MACHINE_TYPE_CUSTOM, expected: MachineType{Cores: 4, Memory: 16384, DiskSize: 100}},
+		{name: "small", expected: MachineType{Cores: 2, Memory: 4096, DiskSize: 40}},
+		{name: "medium", expected: MachineType{Cores: 4, Memory: 16384, DiskSize: 100}},
+		{name: "large", expected: MachineType{Cores: 8, Memory: 32768, DiskSize: 200}},
+		{name: "gpu", file: yamlFile, expected: MachineType{Cores: 16, Memory: 65536, DiskSize: 500}},
+		{name: "small", file: yamlFile, expected: MachineType{Cores: 1, Memory: 2048, DiskSize: 20}},
+		{name: "large", file: yamlFile, expected: MachineType{Cores: 8, Memory: 32768, DiskSize: 200}},
+		{name: "tiny", file: jsonFile, expected: MachineType{Cores: 1, Memory: 1024, DiskSize: 10}},
+		{name: "medium", file: jsonFile, expected: MachineType{Cores: 4, Memory: 16384, DiskSize: 100}},
+	} {
+		machineType, err := GetMachineType(test.name, test.file)
+		if err != nil {
+			t.Errorf("%q from %q: %v", test.name, test.file, err)
+			continue
+		}
+		if machineType != test.expected {
+			t.Errorf("%q from %q: expected %+v, got %+v", test.name, test.file, test.expected, machineType)
+		}
+	}
+}
+
+func TestGetMachineTypeInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+	}{
+		{name: "xlarge"},
+		{name: "gpu", content: "gpu: [16, 65536, 500]"},
+		{name: "gpu", content: `{"gpu": {"cores": "many"}}`},
+		{name: "gpu", content: "gpu:\n  cores: 16\n  memory: 65536\n"},
+		{name: "gpu", content: "gpu:\n  cores: -1\n  memory: 65536\n  diskSize: 500\n"},
+	} {
+		file := ""
+		if test.content != "" {
+			file = writeMachineTypes(t, "types.yaml", test.content)
+		}
+
+		_, err := GetMachineType(test.name, file)
+		if err == nil {
+			t.Errorf("%q from %q: expected an error", test.name, test.content)
+		}
+	}
+
+	_, err := GetMachineType("small", filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("expected a missing file to fail")
+	}
+}
+
+func TestMachineTypePrecedence(t *testing.T) {
+	file := writeMachineTypes(t, "types.yaml", "gpu:\n  cores: 16\n  memory: 65536\n  diskSize: 500\n")
+
+	for _, test := range []struct {
+		env      map[string]string
+		cores    string
+		memory   string
+		diskSize string
+	}{
+		{
+			env:   map[string]string{},
+			cores: "4", memory: "16384", diskSize: "100",
+		},
+		{
+			env:   map[string]string{MACHINE_TYPE: "large"},
+			cores: "8", memory: "32768", diskSize: "200",
+		},
+		{
+			env:   map[string]string{MACHINE_TYPE: "large", VM_CORES: "6"},
+			cores: "6", memory: "32768", diskSize: "200",
+		},
+		{
+			env:   map[string]string{MACHINE_TYPE: "small", VM_MEMORY: "8192", DISK_SIZE: "80"},
+			cores: "2", memory: "8192", diskSize: "80",
+		},
+		{
+			env:   map[string]string{MACHINE_TYPE: "gpu", MACHINE_TYPES_FILE: file, DISK_SIZE: "1000"},
+			cores: "16", memory: "65536", diskSize: "1000",
+		},
+		{
+			env:   map[string]string{MACHINE_TYPE: MACHINE_TYPE_CUSTOM, VM_CORES: "3"},
+			cores: "3", memory: "16384", diskSize: "100",
+		},
+	} {
+		setRequiredEnv(t)
+		for _, name := range []string{MACHINE_TYPE, MACHINE_TYPES_FILE, VM_CORES, VM_MEMORY, DISK_SIZE} {
+			t.Setenv(name, test.env[name])
+		}
+
+		config, err := FromEnv()
+		if err != nil {
+			t.Fatalf("%v: %v", test.env, err)
+		}
+		if config.VmCores != test.cores || config.VmMemory != test.memory || config.DiskSize != test.diskSize {
+			t.Errorf(
+				"%v: expected %s cores, %s MiB and %s GB, got %s, %s and %s",
+				test.env,
+				test.cores,
+				test.memory,
+				test.diskSize,
+				config.VmCores,
+				config.VmMemory,
+				config.DiskSize,
+			)
+		}
+	}
+}
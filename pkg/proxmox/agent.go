@@ -0,0 +1,243 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// AgentTimeout is how long to wait for the guest agent to report an address
+var AgentTimeout = 5 * time.Minute
+
+// AgentPollInterval is how often the guest agent is asked for addresses
+var AgentPollInterval = 3 * time.Second
+
+// public host keys sshd generates on first boot
+var hostKeyFiles = []string{
+	"/etc/ssh/ssh_host_ed25519_key.pub",
+	"/etc/ssh/ssh_host_ecdsa_key.pub",
+	"/etc/ssh/ssh_host_rsa_key.pub",
+}
+
+// interfaces that never carry the address of the guest itself, skipped
+// unless one of them was asked for explicitly
+var ignoredInterfacePrefixes = []string{"docker", "br-", "veth", "virbr", "cni", "flannel"}
+
+// NetworkInterface is an interface reported by the QEMU guest agent
+type NetworkInterface struct {
+	Name            string      `json:"name"`
+	HardwareAddress string      `json:"hardware-address"`
+	IpAddresses     []IpAddress `json:"ip-addresses"`
+}
+
+// IpAddress is an address of a NetworkInterface
+type IpAddress struct {
+	IpAddress     string `json:"ip-address"`
+	IpAddressType string `json:"ip-address-type"`
+	Prefix        int    `json:"prefix"`
+}
+
+// AgentNetworkInterfaces asks the guest agent for the network interfaces
+// of the guest. It fails while the agent is not running.
+func (c *Client) AgentNetworkInterfaces(ctx context.Context, node string, vmid int) ([]NetworkInterface, error) {
+	result := struct {
+		Result []NetworkInterface `json:"result"`
+	}{}
+
+	err := c.Get(ctx, vmPath(node, vmid)+"/agent/network-get-interfaces", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Result, nil
+}
+
+// AgentReadFile reads a file of the guest through the guest agent
+func (c *Client) AgentReadFile(ctx context.Context, node string, vmid int, path string) (string, error) {
+	result := struct {
+		Content string `json:"content"`
+	}{}
+
+	err := c.Get(ctx, vmPath(node, vmid)+"/agent/file-read", url.Values{"file": {path}}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Content, nil
+}
+
+// HostKeys reads the public SSH host keys of the guest through the guest
+// agent, so they don't have to be trusted on first use
+func HostKeys(ctx context.Context, proxmoxClient *Client, node string, vmid int) ([]string, error) {
+	keys := []string{}
+
+	var lastErr error
+	for _, path := range hostKeyFiles {
+		content, err := proxmoxClient.AgentReadFile(ctx, node, vmid, path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		content = strings.TrimSpace(content)
+		if content != "" {
+			keys = append(keys, content)
+		}
+	}
+	if len(keys) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no host keys generated yet")
+		}
+
+		return nil, fmt.Errorf("read host keys of VM %d through the guest agent: %w", vmid, lastErr)
+	}
+
+	return keys, nil
+}
+
+// HostKeySource reads the host keys of the machine of a connection record
+// through the guest agent
+func HostKeySource(proxmoxClient *Client) connection.HostKeySource {
+	return func(ctx context.Context, record *connection.Record) ([]string, error) {
+		return HostKeys(ctx, proxmoxClient, record.Node, record.VmId)
+	}
+}
+
+// SelectAddress picks the address the guest is reachable on. If iface is
+// set only that interface is considered, if cidr is set only addresses
+// inside of it. IPv4 addresses are preferred over IPv6 ones.
+func SelectAddress(interfaces []NetworkInterface, iface string, cidr *net.IPNet) string {
+	ipv6 := ""
+	for _, networkInterface := range interfaces {
+		if iface != "" && networkInterface.Name != iface {
+			continue
+		}
+		if iface == "" && isIgnoredInterface(networkInterface.Name) {
+			continue
+		}
+
+		for _, address := range networkInterface.IpAddresses {
+			ip := net.ParseIP(address.IpAddress)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if cidr != nil && !cidr.Contains(ip) {
+				continue
+			}
+
+			if ip.To4() != nil {
+				return ip.String()
+			}
+			if ipv6 == "" {
+				ipv6 = ip.String()
+			}
+		}
+	}
+
+	return ipv6
+}
+
+func isIgnoredInterface(name string) bool {
+	for _, prefix := range ignoredInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WaitForAddress polls the guest agent until it reports an address
+// matching iface and cidr or AgentTimeout has passed
+func WaitForAddress(
+	ctx context.Context,
+	proxmoxClient *Client,
+	node string,
+	vmid int,
+	iface string,
+	cidr *net.IPNet,
+	logs log.Logger,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, AgentTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(AgentPollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		interfaces, err := proxmoxClient.AgentNetworkInterfaces(ctx, node, vmid)
+		if err == nil {
+			address := SelectAddress(interfaces, iface, cidr)
+			if address != "" {
+				return address, nil
+			}
+
+			lastErr = fmt.Errorf("guest agent reports no matching address yet")
+		} else {
+			lastErr = err
+		}
+
+		logs.Debugf("Waiting for the guest agent of VM %d to report an address: %v", vmid, lastErr)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("discover address of VM %d through the guest agent: %w", vmid, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// GuestAddress returns the address to connect to the guest on. Static
+// cloudinit addresses are used as is, with dhcp the guest agent is asked.
+func GuestAddress(
+	ctx context.Context,
+	proxmoxClient *Client,
+	config *options.Options,
+	node string,
+	vmid int,
+	logs log.Logger,
+) (string, error) {
+	if config.CloudinitIp == options.CLOUDINIT_IP_POOL {
+		return "", fmt.Errorf("no address of the ip pool is leased to this machine")
+	}
+
+	if config.CloudinitIp != options.CLOUDINIT_IP_DHCP {
+		// the ip is in cidr notation, we need to get the address
+		return strings.Split(config.CloudinitIp, "/")[0], nil
+	}
+
+	var cidr *net.IPNet
+	if config.NetworkCidr != "" {
+		var err error
+		_, cidr, err = net.ParseCIDR(config.NetworkCidr)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return WaitForAddress(ctx, proxmoxClient, node, vmid, config.NetworkInterface, cidr, logs)
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
+)
+
+// Client talks to the Proxmox VE API using token authentication
+type Client struct {
+	ApiUrl     string
+	Token      string
+	HttpClient *http.Client
+
+	// Retry is how often a request failing with a transient error is
+	// sent again, see retryable. The zero value sends it once.
+	Retry retry.Policy
+	Log   log.Logger
+}
+
+// NewClient creates a client for the API rooted at apiUrl, which is expected
+// to end in /api2/json
+func NewClient(apiUrl, tokenId, tokenSecret string, insecure bool) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &Client{
+		ApiUrl: strings.TrimSuffix(apiUrl, "/"),
+		Token:  "PVEAPIToken=" + tokenId + "=" + tokenSecret,
+		HttpClient: &http.Client{
+			Transport: transport,
+			Timeout:   60 * time.Second,
+		},
+		Log: log.Default,
+	}
+}
+
+// APIError is returned for every non-2xx response of the API
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Errors     map[string]string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("proxmox api %s %s: %s", e.Method, e.Path, e.Status)
+
+	if len(e.Errors) > 0 {
+		keys := make([]string, 0, len(e.Errors))
+		for key := range e.Errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		details := make([]string, 0, len(keys))
+		for _, key := range keys {
+			details = append(details, key+": "+strings.TrimSpace(e.Errors[key]))
+		}
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	return msg
+}
+
+// IsNotFound reports whether err means the requested object does not exist.
+// Proxmox answers most lookups of missing guests with a 500 and a
+// "does not exist" reason rather than a 404.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return false
+	}
+
+	return apiErr.StatusCode == http.StatusNotFound ||
+		strings.Contains(apiErr.Status, "does not exist")
+}
+
+// Version returns the version of the Proxmox VE API
+func (c *Client) Version(ctx context.Context) (string, error) {
+	version := struct {
+		Version string `json:"version"`
+	}{}
+
+	err := c.Get(ctx, "/version", nil, &version)
+	if err != nil {
+		return "", err
+	}
+
+	return version.Version, nil
+}
+
+// Get performs a GET request and decodes the data field into out
+func (c *Client) Get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	return c.do(ctx, http.MethodGet, path, nil, out)
+}
+
+// Post performs a POST request with a form encoded body
+func (c *Client) Post(ctx context.Context, path string, params url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodPost, path, params, out)
+}
+
+// Put performs a PUT request with a form encoded body
+func (c *Client) Put(ctx context.Context, path string, params url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodPut, path, params, out)
+}
+
+// Delete performs a DELETE request, passing params as query
+func (c *Client) Delete(ctx context.Context, path string, params url.Values, out interface{}) error {
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	return c.do(ctx, http.MethodDelete, path, nil, out)
+}
+
+// retryable reports whether a request that failed with err may be sent
+// again. Reads are retried on any transient error. Changes only if they
+// certainly didn't happen: the connection was never made, pveproxy was
+// unavailable, or the API refused the request as the guest's config was
+// locked by another operation. Tasks failing after the request succeeded
+// are reported by WaitForTask and never retried.
+func retryable(method string, err error) bool {
+	if method == http.MethodGet {
+		return retry.IsTransient(err)
+	}
+
+	opErr := &net.OpError{}
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	apiErr := &APIError{}
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	status := strings.ToLower(apiErr.Status)
+
+	return apiErr.StatusCode == http.StatusServiceUnavailable ||
+		strings.Contains(status, "is locked") ||
+		strings.Contains(status, "can't lock file")
+}
+
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	operation := method + " " + strings.SplitN(path, "?", 2)[0]
+	return retry.Do(ctx, c.Retry, operation, c.Log, func(err error) bool {
+		return retryable(method, err)
+	}, func() error {
+		return c.send(ctx, method, path, params, out)
+	})
+}
+
+func (c *Client) send(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.ApiUrl+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", c.Token)
+	req.Header.Set("Accept", "application/json")
+	if params != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{
+			Method:     method,
+			Path:       strings.SplitN(path, "?", 2)[0],
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+
+		errBody := struct {
+			Errors map[string]string `json:"errors"`
+		}{}
+		if json.Unmarshal(raw, &errBody) == nil {
+			apiErr.Errors = errBody.Errors
+		}
+
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	envelope := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	err = json.Unmarshal(raw, &envelope)
+	if err != nil {
+		return fmt.Errorf("decode response of %s %s: %w", method, path, err)
+	}
+
+	err = json.Unmarshal(envelope.Data, out)
+	if err != nil {
+		return fmt.Errorf("decode response of %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
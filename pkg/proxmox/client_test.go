@@ -0,0 +1,298 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
+)
+
+// fakeReply is the answer of the fake api to one request. Reason replaces
+// the standard status text, as proxmox puts its error messages there.
+type fakeReply struct {
+	Code   int
+	Reason string
+	Body   string
+}
+
+// fakeApi is an in-process stand-in for the Proxmox VE API. Routes are
+// keyed by method and path below /api2/json, e.g. "GET /version".
+type fakeApi struct {
+	mu     sync.Mutex
+	routes map[string]func(form url.Values) fakeReply
+	calls  []string
+	forms  map[string]url.Values
+}
+
+func newFakeApi(t *testing.T) (*fakeApi, *Client) {
+	api := &fakeApi{
+		routes: map[string]func(form url.Values) fakeReply{},
+		forms:  map[string]url.Values{},
+	}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	pollInterval := TaskPollInterval
+	TaskPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		TaskPollInterval = pollInterval
+	})
+
+	return api, NewClient(server.URL+"/api2/json", "devpod@pve!test", "secret", false)
+}
+
+// handle answers every request to route with body
+func (a *fakeApi) handle(route string, body string) {
+	a.handleFunc(route, func(url.Values) fakeReply {
+		return fakeReply{Code: http.StatusOK, Body: body}
+	})
+}
+
+func (a *fakeApi) handleFunc(route string, reply func(form url.Values) fakeReply) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.routes[route] = reply
+}
+
+func (a *fakeApi) called() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]string{}, a.calls...)
+}
+
+func (a *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "PVEAPIToken=devpod@pve!test=secret" {
+		http.Error(w, "no token", http.StatusUnauthorized)
+		return
+	}
+
+	_ = r.ParseForm()
+	route := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/api2/json")
+
+	a.mu.Lock()
+	a.calls = append(a.calls, route)
+	a.forms[route] = r.Form
+	reply, ok := a.routes[route]
+	a.mu.Unlock()
+
+	if !ok {
+		writeReply(w, fakeReply{Code: http.StatusNotFound, Body: `{"data":null}`})
+		return
+	}
+
+	writeReply(w, reply(r.Form))
+}
+
+func writeReply(w http.ResponseWriter, reply fakeReply) {
+	if reply.Reason == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(reply.Code)
+		fmt.Fprint(w, reply.Body)
+		return
+	}
+
+	// net/http always sends the standard status text
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		reply.Code, reply.Reason, len(reply.Body), reply.Body)
+	_ = buf.Flush()
+}
+
+// taskRoute is the status route of upid
+func taskRoute(upid string) string {
+	node, _ := TaskNode(upid)
+	return "GET /nodes/" + node + "/tasks/" + upid + "/status"
+}
+
+func TestVersion(t *testing.T) {
+	api, client := newFakeApi(t)
+	api.handle("GET /version", `{"data":{"version":"8.1.4","release":"8.1"}}`)
+
+	version, err := client.Version(context.Background())
+	if err != nil || version != "8.1.4" {
+		t.Fatalf("expected version 8.1.4, got %q, %v", version, err)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	api, client := newFakeApi(t)
+	api.handleFunc("GET /nodes/pve/qemu/100/status/current", func(url.Values) fakeReply {
+		return fakeReply{
+			Code:   http.StatusInternalServerError,
+			Reason: "Configuration file 'nodes/pve/qemu-server/100.conf' does not exist",
+			Body:   `{"data":null}`,
+		}
+	})
+	api.handleFunc("GET /nodes/pve/qemu/101/status/current", func(url.Values) fakeReply {
+		return fakeReply{
+			Code:   http.StatusInternalServerError,
+			Reason: "VM is locked (clone)",
+			Body:   `{"data":null,"errors":{"vmid":"locked"}}`,
+		}
+	})
+
+	// unknown routes answer 404
+	_, err := client.GetVMStatus(context.Background(), "pve", 99)
+	if !IsNotFound(err) {
+		t.Errorf("expected a 404 to be not found, got %v", err)
+	}
+
+	_, err = client.GetVMStatus(context.Background(), "pve", 100)
+	if !IsNotFound(err) {
+		t.Errorf("expected a missing config to be not found, got %v", err)
+	}
+
+	_, err = client.GetVMStatus(context.Background(), "pve", 101)
+	if err == nil || IsNotFound(err) {
+		t.Fatalf("expected a locked VM to be an error other than not found, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "VM is locked (clone)") || !strings.Contains(err.Error(), "vmid: locked") {
+		t.Errorf("expected reason and errors in %q", err.Error())
+	}
+
+	if IsNotFound(fmt.Errorf("dial tcp: connection refused")) {
+		t.Errorf("expected errors other than api errors not to be not found")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "https://pve:8006", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	reset := &url.Error{Op: "Post", URL: "https://pve:8006", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	apiError := func(method string, code int, status string) error {
+		return &APIError{Method: method, Path: "/nodes/pve/qemu/200/config", StatusCode: code, Status: status}
+	}
+
+	for _, test := range []struct {
+		method    string
+		err       error
+		retryable bool
+	}{
+		{method: http.MethodGet, err: refused, retryable: true},
+		{method: http.MethodGet, err: reset, retryable: true},
+		{method: http.MethodGet, err: apiError(http.MethodGet, 502, "502 Bad Gateway"), retryable: true},
+		{method: http.MethodGet, err: apiError(http.MethodGet, 596, "596 Connection timed out"), retryable: true},
+		{method: http.MethodGet, err: apiError(http.MethodGet, 500, "500 VM 200 is locked (clone)")},
+		{method: http.MethodGet, err: apiError(http.MethodGet, 500, "500 Configuration file 'nodes/pve/qemu-server/200.conf' does not exist")},
+		{method: http.MethodPost, err: refused, retryable: true},
+		{method: http.MethodPost, err: apiError(http.MethodPost, 503, "503 Service Unavailable"), retryable: true},
+		{method: http.MethodPost, err: apiError(http.MethodPost, 500, "500 VM 200 is locked (clone)"), retryable: true},
+		{method: http.MethodPut, err: apiError(http.MethodPut, 500, "500 can't lock file '/var/lock/qemu-server/lock-200.conf' - got timeout"), retryable: true},
+		// the request may have been carried out
+		{method: http.MethodPost, err: reset},
+		{method: http.MethodPost, err: apiError(http.MethodPost, 502, "502 Bad Gateway")},
+		{method: http.MethodPost, err: apiError(http.MethodPost, 596, "596 Connection timed out")},
+		{method: http.MethodPost, err: apiError(http.MethodPost, 500, "500 got timeout")},
+		{method: http.MethodDelete, err: apiError(http.MethodDelete, 400, "400 Parameter verification failed")},
+		{method: http.MethodPost, err: context.Canceled},
+		{method: http.MethodGet, err: errors.New("task UPID:pve:1:1:1:qmclone:9000:devpod@pve!test: failed: can't lock file - got timeout")},
+	} {
+		if retryable(test.method, test.err) != test.retryable {
+			t.Errorf("%s: expected %v to be retryable: %v", test.method, test.err, test.retryable)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	baseDelay := retry.BaseDelay
+	retry.BaseDelay = time.Millisecond
+	t.Cleanup(func() {
+		retry.BaseDelay = baseDelay
+	})
+
+	api, client := newFakeApi(t)
+	client.Retry = retry.Policy{Attempts: 3, Timeout: time.Minute}
+
+	// replies answers the requests to route in turn, repeating the last
+	replies := func(route string, replies ...fakeReply) {
+		api.handleFunc(route, func(url.Values) fakeReply {
+			reply := replies[0]
+			if len(replies) > 1 {
+				replies = replies[1:]
+			}
+			return reply
+		})
+	}
+	unavailable := fakeReply{Code: http.StatusServiceUnavailable, Body: `{"data":null}`}
+	locked := fakeReply{Code: http.StatusInternalServerError, Reason: "VM 200 is locked (clone)", Body: `{"data":null}`}
+	timeout := fakeReply{Code: http.StatusInternalServerError, Reason: "got timeout", Body: `{"data":null}`}
+	gateway := fakeReply{Code: http.StatusBadGateway, Body: `{"data":null}`}
+
+	replies("GET /version", unavailable, gateway, fakeReply{Code: http.StatusOK, Body: `{"data":{"version":"8.1.4"}}`})
+	replies("POST /nodes/pve/qemu/200/config", locked, fakeReply{Code: http.StatusOK, Body: `{"data":"UPID:pve:1:1:1:qmconfig:200:devpod@pve!test:"}`})
+	replies("POST /nodes/pve/qemu/200/status/start", timeout)
+	replies("POST /nodes/pve/qemu/200/status/stop", gateway)
+	replies("DELETE /nodes/pve/qemu/200", unavailable)
+
+	version, err := client.Version(context.Background())
+	if err != nil || version != "8.1.4" {
+		t.Fatalf("expected the third attempt to succeed, got %q, %v", version, err)
+	}
+	err = client.Post(context.Background(), "/nodes/pve/qemu/200/config", url.Values{"cores": {"2"}}, nil)
+	if err != nil {
+		t.Fatalf("expected the locked config to be retried, got %v", err)
+	}
+	err = client.Post(context.Background(), "/nodes/pve/qemu/200/status/start", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "got timeout") {
+		t.Fatalf("expected the timeout to be returned, got %v", err)
+	}
+	err = client.Post(context.Background(), "/nodes/pve/qemu/200/status/stop", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("expected the bad gateway to be returned, got %v", err)
+	}
+	err = client.Delete(context.Background(), "/nodes/pve/qemu/200", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the last error after the attempts, got %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, call := range api.called() {
+		counts[call]++
+	}
+	for route, expected := range map[string]int{
+		"GET /version":                          3,
+		"POST /nodes/pve/qemu/200/config":       2,
+		"POST /nodes/pve/qemu/200/status/start": 1,
+		"POST /nodes/pve/qemu/200/status/stop":  1,
+		"DELETE /nodes/pve/qemu/200":            3,
+	} {
+		if counts[route] != expected {
+			t.Errorf("expected %s to be sent %d times, got %d", route, expected, counts[route])
+		}
+	}
+	if api.forms["POST /nodes/pve/qemu/200/config"].Get("cores") != "2" {
+		t.Errorf("expected the retried request to carry its form, got %v", api.forms["POST /nodes/pve/qemu/200/config"])
+	}
+}
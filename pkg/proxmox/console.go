@@ -0,0 +1,244 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConsoleEscape ends a console session when typed, Ctrl-]
+const ConsoleEscape = 0x1d
+
+// ConsolePingInterval keeps the termproxy session from timing out
+var ConsolePingInterval = 30 * time.Second
+
+// TermProxy is a ticket to attach to a terminal of a VM
+type TermProxy struct {
+	Port   json.Number `json:"port"`
+	Ticket string      `json:"ticket"`
+	User   string      `json:"user"`
+	Upid   string      `json:"upid"`
+}
+
+// TermProxy starts a termproxy for the serial port of the VM, e.g. serial0
+func (c *Client) TermProxy(ctx context.Context, node string, vmid int, serial string) (*TermProxy, error) {
+	proxy := &TermProxy{}
+	err := c.Post(ctx, vmPath(node, vmid)+"/termproxy", url.Values{"serial": {serial}}, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+// VncWebsocket connects to the websocket of a termproxy
+func (c *Client) VncWebsocket(ctx context.Context, node string, vmid int, proxy *TermProxy) (*websocket.Conn, error) {
+	wsUrl, err := url.Parse(c.ApiUrl + vmPath(node, vmid) + "/vncwebsocket")
+	if err != nil {
+		return nil, err
+	}
+	wsUrl.Scheme = strings.Replace(wsUrl.Scheme, "http", "ws", 1)
+	wsUrl.RawQuery = url.Values{"port": {proxy.Port.String()}, "vncticket": {proxy.Ticket}}.Encode()
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+	}
+	if transport, ok := c.HttpClient.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, wsUrl.String(), http.Header{"Authorization": {c.Token}})
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("connect to the console of VM %d: %s", vmid, resp.Status)
+		}
+
+		return nil, fmt.Errorf("connect to the console of VM %d: %w", vmid, err)
+	}
+
+	return conn, nil
+}
+
+// AttachConsole bridges the serial console of the VM to stdin and stdout until
+// the connection closes, ctx is done or ConsoleEscape is read from stdin.
+// cols and rows set the size of the terminal if positive.
+func AttachConsole(
+	ctx context.Context,
+	proxmoxClient *Client,
+	node string,
+	vmid int,
+	stdin io.Reader,
+	stdout io.Writer,
+	cols int,
+	rows int,
+) error {
+	proxy, err := proxmoxClient.TermProxy(ctx, node, vmid, "serial0")
+	if err != nil {
+		return fmt.Errorf("open the serial console of VM %d: %w", vmid, err)
+	}
+
+	conn, err := proxmoxClient.VncWebsocket(ctx, node, vmid, proxy)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session := &consoleSession{conn: conn}
+	err = session.send(proxy.User + ":" + proxy.Ticket + "\n")
+	if err != nil {
+		return err
+	}
+
+	// the first message acknowledges the ticket
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("authenticate to the console of VM %d: %w", vmid, err)
+	}
+	if !bytes.HasPrefix(message, []byte("OK")) {
+		return fmt.Errorf("authenticate to the console of VM %d: %s", vmid, strings.TrimSpace(string(message)))
+	}
+	_, _ = stdout.Write(message[2:])
+
+	if cols > 0 && rows > 0 {
+		err = session.send("1:" + strconv.Itoa(cols) + ":" + strconv.Itoa(rows) + ":")
+		if err != nil {
+			return err
+		}
+	}
+
+	done := make(chan error, 3)
+	go func() {
+		done <- session.forwardInput(stdin)
+	}()
+	go func() {
+		done <- session.keepAlive(ctx)
+	}()
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					err = nil
+				}
+				done <- err
+				return
+			}
+
+			_, err = stdout.Write(message)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+	}
+	_ = session.close()
+
+	return err
+}
+
+// consoleSession speaks the termproxy protocol: 0:<length>:<data> is
+// input, 1:<cols>:<rows>: a resize and 2 a ping
+type consoleSession struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (s *consoleSession) send(message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+func (s *consoleSession) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+}
+
+// forwardInput sends stdin to the console until it ends or the escape
+// character is read
+func (s *consoleSession) forwardInput(stdin io.Reader) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			input := buf[:n]
+			escape := bytes.IndexByte(input, ConsoleEscape)
+			if escape >= 0 {
+				input = input[:escape]
+			}
+
+			if len(input) > 0 {
+				sendErr := s.send("0:" + strconv.Itoa(len(input)) + ":" + string(input))
+				if sendErr != nil {
+					return sendErr
+				}
+			}
+			if escape >= 0 {
+				return nil
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func (s *consoleSession) keepAlive(ctx context.Context) error {
+	ticker := time.NewTicker(ConsolePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := s.send("2")
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is written by the console while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// fakeTermProxy serves termproxy and vncwebsocket for VM 200 on node pve.
+// Every message after the ticket is passed to received, which is closed
+// with the connection. reply answers the ticket.
+func fakeTermProxy(t *testing.T, reply string, received chan<- string) *Client {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api2/json/nodes/pve/qemu/200/termproxy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("serial") != "serial0" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprint(w, `{"data":{"port":5900,"ticket":"PVEVNC:ticket","user":"devpod@pve!test","upid":"UPID:pve:1:1:1:vncproxy:200:devpod@pve!test:"}}`)
+	})
+	mux.HandleFunc("/api2/json/nodes/pve/qemu/200/vncwebsocket", func(w http.ResponseWriter, r *http.Request) {
+		defer close(received)
+
+		if r.Header.Get("Authorization") != "PVEAPIToken=devpod@pve!test=secret" ||
+			r.URL.Query().Get("port") != "5900" || r.URL.Query().Get("vncticket") != "PVEVNC:ticket" {
+			http.Error(w, "no ticket", http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, message, err := conn.ReadMessage()
+		if err != nil || string(message) != "devpod@pve!test:PVEVNC:ticket\n" {
+			t.Errorf("expected the ticket first, got %q, %v", message, err)
+			return
+		}
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(reply))
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(message)
+
+			// the console answers once it has a size
+			if strings.HasPrefix(string(message), "1:") {
+				_ = conn.WriteMessage(websocket.BinaryMessage, []byte("login: "))
+			}
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return NewClient(server.URL+"/api2/json", "devpod@pve!test", "secret", false)
+}
+
+// nextMessage returns the next message other than a ping and whether a
+// ping was skipped
+func nextMessage(t *testing.T, received <-chan string) (string, bool) {
+	pinged := false
+	for {
+		select {
+		case message, ok := <-received:
+			if !ok {
+				return "", pinged
+			}
+			if message == "2" {
+				pinged = true
+				continue
+			}
+
+			return message, pinged
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the console")
+		}
+	}
+}
+
+func TestAttachConsole(t *testing.T) {
+	pingInterval := ConsolePingInterval
+	ConsolePingInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		ConsolePingInterval = pingInterval
+	})
+
+	received := make(chan string, 100)
+	proxmoxClient := fakeTermProxy(t, "OKwelcome\r\n", received)
+
+	stdin, input := io.Pipe()
+	stdout := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- AttachConsole(context.Background(), proxmoxClient, "pve", 200, stdin, stdout, 80, 24)
+	}()
+
+	message, _ := nextMessage(t, received)
+	if message != "1:80:24:" {
+		t.Fatalf("expected the terminal size first, got %q", message)
+	}
+
+	_, _ = input.Write([]byte("ls -l\n"))
+	message, _ = nextMessage(t, received)
+	if message != "0:6:ls -l\n" {
+		t.Fatalf("expected framed input, got %q", message)
+	}
+
+	// wait for a ping before typing on
+	pinged := false
+	for !pinged {
+		select {
+		case message := <-received:
+			pinged = message == "2"
+			if !pinged {
+				t.Fatalf("expected only pings while idle, got %q", message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session to be kept alive")
+		}
+	}
+
+	// everything from the escape on stays local
+	_, _ = input.Write([]byte("x\x1dexit\n"))
+	message, _ = nextMessage(t, received)
+	if message != "0:1:x" {
+		t.Fatalf("expected the input before the escape, got %q", message)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the escape to end the session, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the escape to end the session")
+	}
+
+	// the close ends the connection without more input
+	message, _ = nextMessage(t, received)
+	if message != "" {
+		t.Fatalf("expected no input after the escape, got %q", message)
+	}
+
+	if output := stdout.String(); output != "welcome\r\nlogin: " {
+		t.Errorf("expected the console output on stdout, got %q", output)
+	}
+}
+
+func TestAttachConsoleRejected(t *testing.T) {
+	received := make(chan string, 100)
+	proxmoxClient := fakeTermProxy(t, "permission denied\n", received)
+
+	err := AttachConsole(context.Background(), proxmoxClient, "pve", 200, strings.NewReader(""), io.Discard, 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected the rejected ticket to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// ExecPollInterval is how often the guest agent is asked whether a
+// command exited
+var ExecPollInterval = 500 * time.Millisecond
+
+// maxInputData is the most stdin the api passes on to the guest agent
+// along with the command, more is staged in files first
+const maxInputData = 64 * 1024
+
+// maxStagedInput bounds the stdin staged through the guest agent
+const maxStagedInput = 256 * 1024 * 1024
+
+// fileWriteChunk is how much stdin goes into one staged file, so that its
+// base64 encoding fits the 61440 characters file-write takes
+const fileWriteChunk = 45 * 1024
+
+// cleanupTimeout bounds removing staged stdin after the operation ended
+const cleanupTimeout = 30 * time.Second
+
+// ErrStreaming is returned by auto when it would fall back to the guest
+// agent for a command with piped stdin. The guest agent passes stdin
+// before a command starts and its output after it exited, so it can't
+// carry DevPod's agent or its tunnels, which talk over stdio while they
+// run.
+var ErrStreaming = errors.New(
+	"the guest agent can't stream stdin and stdout, so it doesn't run commands talking over stdio like DevPod's agent. " +
+		"Make the VM reachable over SSH, or set COMMAND_TRANSPORT to guest-agent to pass stdin to the command up to its end",
+)
+
+// ExecStatus is the state of a command started through the guest agent
+type ExecStatus struct {
+	Exited       int    `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated int    `json:"out-truncated"`
+	ErrTruncated int    `json:"err-truncated"`
+}
+
+// AgentExitError is returned when a command run through the guest agent
+// exits non-zero
+type AgentExitError struct {
+	Code int
+}
+
+func (e *AgentExitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.Code)
+}
+
+// ExitStatus returns the exit code of the command
+func (e *AgentExitError) ExitStatus() int {
+	return e.Code
+}
+
+// AgentExec starts args in the guest with input as stdin and returns the
+// pid to poll AgentExecStatus with
+func (c *Client) AgentExec(ctx context.Context, node string, vmid int, args []string, input string) (int, error) {
+	params := url.Values{"command": args}
+	if input != "" {
+		params.Set("input-data", input)
+	}
+
+	result := struct {
+		Pid int `json:"pid"`
+	}{}
+	err := c.Post(ctx, vmPath(node, vmid)+"/agent/exec", params, &result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Pid, nil
+}
+
+// AgentExecStatus returns the state of a command started with AgentExec
+func (c *Client) AgentExecStatus(ctx context.Context, node string, vmid, pid int) (*ExecStatus, error) {
+	status := &ExecStatus{}
+	err := c.Get(ctx, vmPath(node, vmid)+"/agent/exec-status", url.Values{"pid": {strconv.Itoa(pid)}}, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// AgentFileWrite writes content to a file in the guest through the guest
+// agent
+func (c *Client) AgentFileWrite(ctx context.Context, node string, vmid int, path string, content []byte) error {
+	return c.Post(ctx, vmPath(node, vmid)+"/agent/file-write", url.Values{
+		"file":    {path},
+		"content": {base64.StdEncoding.EncodeToString(content)},
+		"encode":  {"0"},
+	}, nil)
+}
+
+// AgentCommand runs command with sh as root through the guest agent. The
+// agent can't stream: stdin is read up to its end before the command
+// starts, larger input is staged in a private directory in the guest
+// first, and the agent only hands out the output once the command exited.
+func AgentCommand(
+	ctx context.Context,
+	proxmoxClient *Client,
+	node string,
+	vmid int,
+	command string,
+	stdin io.Reader,
+	stdout io.Writer,
+	stderr io.Writer,
+) error {
+	input := []byte{}
+	if stdin != nil {
+		var err error
+		input, err = readInput(stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"/bin/sh", "-c", command}
+	started := false
+	if len(input) > maxInputData {
+		dir, err := stageInput(ctx, proxmoxClient, node, vmid, input)
+		if err != nil {
+			return err
+		}
+
+		// the command removes the staged input when it exits, it is only
+		// removed from here if the command never started
+		defer func() {
+			if !started {
+				removeStaged(proxmoxClient, node, vmid, dir)
+			}
+		}()
+
+		args = []string{
+			"/bin/sh", "-c",
+			`dir=$1; shift; cat "$dir"/* | /bin/sh -c "$1"; rc=$?; rm -rf "$dir"; exit $rc`,
+			"sh", dir, command,
+		}
+		input = nil
+	}
+
+	status, err := agentRun(ctx, proxmoxClient, node, vmid, args, string(input), func() { started = true })
+	if err != nil {
+		return err
+	}
+
+	return commandResult(status, stdout, stderr)
+}
+
+// agentRun starts args through the guest agent and waits for them to
+// exit. started is called once the agent started them.
+func agentRun(
+	ctx context.Context,
+	proxmoxClient *Client,
+	node string,
+	vmid int,
+	args []string,
+	input string,
+	started func(),
+) (*ExecStatus, error) {
+	pid, err := proxmoxClient.AgentExec(ctx, node, vmid, args, input)
+	if err != nil {
+		return nil, fmt.Errorf("run command through the guest agent of VM %d: %w", vmid, err)
+	}
+	if started != nil {
+		started()
+	}
+
+	ticker := time.NewTicker(ExecPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := proxmoxClient.AgentExecStatus(ctx, node, vmid, pid)
+		if err != nil {
+			return nil, fmt.Errorf("get status of command %d in VM %d: %w", pid, vmid, err)
+		}
+		if status.Exited == 1 {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("command %d in VM %d still running: %w", pid, vmid, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// commandResult writes the output of an exited command and returns its
+// exit code as error
+func commandResult(status *ExecStatus, stdout io.Writer, stderr io.Writer) error {
+	_, _ = io.WriteString(stdout, status.OutData)
+	_, _ = io.WriteString(stderr, status.ErrData)
+	if status.OutTruncated == 1 || status.ErrTruncated == 1 {
+		_, _ = io.WriteString(stderr, "output truncated by the guest agent\n")
+	}
+
+	if status.Signal != 0 {
+		return &AgentExitError{Code: 128 + status.Signal}
+	}
+	if status.ExitCode != 0 {
+		return &AgentExitError{Code: status.ExitCode}
+	}
+
+	return nil
+}
+
+// readInput reads stdin up to its end, however long the writer takes
+func readInput(stdin io.Reader) ([]byte, error) {
+	input, err := io.ReadAll(io.LimitReader(stdin, maxStagedInput+1))
+	if err != nil {
+		return nil, fmt.Errorf("read stdin: %w", err)
+	}
+	if len(input) > maxStagedInput {
+		return nil, fmt.Errorf("the guest agent takes at most %d MiB of stdin", maxStagedInput/1024/1024)
+	}
+
+	return input, nil
+}
+
+// stageInput writes input to numbered files in a directory only root can
+// read, created by mktemp in the guest, and returns the directory. The
+// directory is removed again if staging fails.
+func stageInput(ctx context.Context, proxmoxClient *Client, node string, vmid int, input []byte) (string, error) {
+	status, err := agentRun(ctx, proxmoxClient, node, vmid, []string{"/bin/sh", "-c", "mktemp -d /tmp/devpod-stdin.XXXXXXXX"}, "", nil)
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(status.OutData)
+	if status.ExitCode != 0 || !strings.HasPrefix(dir, "/tmp/devpod-stdin.") {
+		return "", fmt.Errorf("create a directory for stdin in VM %d: %s", vmid, strings.TrimSpace(status.ErrData))
+	}
+
+	for i := 0; len(input) > 0; i++ {
+		size := fileWriteChunk
+		if len(input) < size {
+			size = len(input)
+		}
+
+		err := proxmoxClient.AgentFileWrite(ctx, node, vmid, fmt.Sprintf("%s/%06d", dir, i), input[:size])
+		if err != nil {
+			removeStaged(proxmoxClient, node, vmid, dir)
+			return "", fmt.Errorf("stage stdin in VM %d through the guest agent: %w", vmid, err)
+		}
+		input = input[size:]
+	}
+
+	return dir, nil
+}
+
+// removeStaged removes the staged stdin in dir, also once the operation
+// was cancelled
+func removeStaged(proxmoxClient *Client, node string, vmid int, dir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	_, _ = agentRun(ctx, proxmoxClient, node, vmid, []string{"/bin/sh", "-c", `rm -rf "$1"`, "sh", dir}, "", nil)
+}
+
+// RunCommand runs command over the transport selected by
+// COMMAND_TRANSPORT. overSSH runs it over SSH, vm looks up the node and
+// id of the VM for the guest agent. With auto the guest agent is only
+// used if the machine can't be reached over SSH.
+func RunCommand(
+	ctx context.Context,
+	proxmoxClient *Client,
+	config *options.Options,
+	command string,
+	overSSH func() error,
+	vm func() (string, int, error),
+	logs log.Logger,
+) error {
+	switch config.CommandTransport {
+	case options.COMMAND_TRANSPORT_SSH:
+		return overSSH()
+	case options.COMMAND_TRANSPORT_AUTO:
+		err := overSSH()
+		unreachableErr := &connection.UnreachableError{}
+		if !errors.As(err, &unreachableErr) {
+			return err
+		}
+
+		// the caller may talk to the command while it runs, which it
+		// expects SSH to carry
+		if stdinIfPiped() != nil {
+			return fmt.Errorf("%w: %w", err, ErrStreaming)
+		}
+
+		logs.Warnf("Machine not reachable over SSH, running the command through the guest agent: %v", err)
+	}
+
+	node, vmid, err := vm()
+	if err != nil {
+		return err
+	}
+
+	return AgentCommand(ctx, proxmoxClient, node, vmid, command, stdinIfPiped(), os.Stdout, os.Stderr)
+}
+
+// stdinIfPiped returns stdin unless it is a terminal, which would never
+// reach EOF
+func stdinIfPiped() io.Reader {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return nil
+	}
+
+	return os.Stdin
+}
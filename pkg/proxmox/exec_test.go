@@ -0,0 +1,223 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// fakeAgent serves agent/exec, agent/exec-status and agent/file-write.
+// mktemp and rm run right away, other commands exit with status on the
+// second poll.
+type fakeAgent struct {
+	mu        sync.Mutex
+	execs     [][]string
+	inputs    []string
+	files     map[string][]byte
+	polls     int
+	status    string
+	failWrite bool
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_ = r.ParseForm()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/agent/exec"):
+		a.execs = append(a.execs, r.PostForm["command"])
+		a.inputs = append(a.inputs, r.PostForm.Get("input-data"))
+		fmt.Fprintf(w, `{"data":{"pid":%d}}`, len(a.execs))
+	case strings.HasSuffix(r.URL.Path, "/agent/file-write"):
+		content, err := base64.StdEncoding.DecodeString(r.PostForm.Get("content"))
+		if a.failWrite || err != nil || r.PostForm.Get("encode") != "0" || len(r.PostForm.Get("content")) > 61440 {
+			http.Error(w, "bad content", http.StatusBadRequest)
+			return
+		}
+		a.files[r.PostForm.Get("file")] = content
+		fmt.Fprint(w, `{"data":null}`)
+	case strings.HasSuffix(r.URL.Path, "/agent/exec-status"):
+		pid, _ := strconv.Atoi(r.URL.Query().Get("pid"))
+		command := strings.Join(a.execs[pid-1], " ")
+		switch {
+		case strings.Contains(command, "mktemp -d"):
+			fmt.Fprint(w, `{"data":{"exited":1,"exitcode":0,"out-data":"/tmp/devpod-stdin.a1b2c3d4\n"}}`)
+			return
+		case strings.Contains(command, "rm -rf"):
+			fmt.Fprint(w, `{"data":{"exited":1,"exitcode":0}}`)
+			return
+		}
+
+		a.polls++
+		if a.polls < 2 {
+			fmt.Fprint(w, `{"data":{"exited":0}}`)
+			return
+		}
+		fmt.Fprint(w, a.status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeAgent(t *testing.T, status string) (*fakeAgent, *Client) {
+	agent := &fakeAgent{files: map[string][]byte{}, status: status}
+	server := httptest.NewServer(agent)
+	t.Cleanup(server.Close)
+
+	pollInterval := ExecPollInterval
+	ExecPollInterval = time.Millisecond
+	t.Cleanup(func() {
+		ExecPollInterval = pollInterval
+	})
+
+	return agent, NewClient(server.URL, "user@pam!token", "secret", false)
+}
+
+func TestAgentCommandExitCode(t *testing.T) {
+	agent, client := newFakeAgent(t, `{"data":{"exited":1,"exitcode":3,"out-data":"out\n","err-data":"err\n"}}`)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	err := AgentCommand(context.Background(), client, "pve", 100, "echo hi", strings.NewReader("input"), stdout, stderr)
+
+	exitErr := &AgentExitError{}
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("expected exit code 3, got %v", err)
+	}
+	if len(agent.execs) != 1 || strings.Join(agent.execs[0], " ") != "/bin/sh -c echo hi" || agent.inputs[0] != "input" {
+		t.Errorf("unexpected execs %q with input %q", agent.execs, agent.inputs)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("unexpected output %q, %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestAgentCommandStagesLargeInput(t *testing.T) {
+	agent, client := newFakeAgent(t, `{"data":{"exited":1,"exitcode":0}}`)
+
+	input := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100*1024)
+	err := AgentCommand(context.Background(), client, "pve", 100, "cat > agent", bytes.NewReader(input), io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the command reads and removes the directory mktemp created
+	if len(agent.execs) != 2 || !strings.Contains(strings.Join(agent.execs[0], " "), "mktemp -d") {
+		t.Fatalf("expected a directory to be created for the input, got %q", agent.execs)
+	}
+	args := agent.execs[1]
+	if agent.inputs[1] != "" || len(args) != 6 || args[4] != "/tmp/devpod-stdin.a1b2c3d4" || args[5] != "cat > agent" {
+		t.Fatalf("expected the command to read staged input, got %q with input of %d bytes", args, len(agent.inputs[1]))
+	}
+	if !strings.Contains(args[2], `rm -rf "$dir"`) {
+		t.Errorf("expected the command to remove the staged input, got %q", args[2])
+	}
+
+	staged := []byte{}
+	for i := 0; i < len(agent.files); i++ {
+		staged = append(staged, agent.files[fmt.Sprintf("/tmp/devpod-stdin.a1b2c3d4/%06d", i)]...)
+	}
+	if !bytes.Equal(staged, input) {
+		t.Errorf("staged %d bytes in %d files, expected %d bytes", len(staged), len(agent.files), len(input))
+	}
+}
+
+func TestAgentCommandRemovesStagedInput(t *testing.T) {
+	agent, client := newFakeAgent(t, `{"data":{"exited":1,"exitcode":0}}`)
+	agent.failWrite = true
+
+	input := bytes.Repeat([]byte{1}, 2*maxInputData)
+	err := AgentCommand(context.Background(), client, "pve", 100, "cat > agent", bytes.NewReader(input), io.Discard, io.Discard)
+	if err == nil {
+		t.Fatal("expected staging to fail")
+	}
+
+	last := agent.execs[len(agent.execs)-1]
+	if len(agent.execs) != 2 || !strings.Contains(strings.Join(last, " "), "rm -rf") || last[len(last)-1] != "/tmp/devpod-stdin.a1b2c3d4" {
+		t.Errorf("expected the staged input to be removed, got %q", agent.execs)
+	}
+}
+
+// TestAgentCommandSlowInput passes stdin that pauses between writes
+func TestAgentCommandSlowInput(t *testing.T) {
+	agent, client := newFakeAgent(t, `{"data":{"exited":1,"exitcode":0}}`)
+
+	stdin, writer := io.Pipe()
+	go func() {
+		for _, part := range []string{"slow ", "but ", "steady"} {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = io.WriteString(writer, part)
+		}
+		_ = writer.Close()
+	}()
+
+	err := AgentCommand(context.Background(), client, "pve", 100, "cat", stdin, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.inputs[0] != "slow but steady" {
+		t.Errorf("expected all of stdin to be passed, got %q", agent.inputs[0])
+	}
+}
+
+func TestRunCommandAutoRefusesStreaming(t *testing.T) {
+	_, client := newFakeAgent(t, `{"data":{"exited":1,"exitcode":0}}`)
+
+	stdin, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	defer stdin.Close()
+
+	osStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() {
+		os.Stdin = osStdin
+	}()
+
+	config := &options.Options{CommandTransport: options.COMMAND_TRANSPORT_AUTO}
+	unreachable := func() error {
+		return &connection.UnreachableError{Err: errors.New("no route to host")}
+	}
+	vm := func() (string, int, error) {
+		t.Fatal("expected the guest agent not to be used")
+		return "", 0, nil
+	}
+
+	err = RunCommand(context.Background(), client, config, "devpod agent", unreachable, vm, log.Default)
+	if !errors.Is(err, ErrStreaming) {
+		t.Fatalf("expected ErrStreaming, got %v", err)
+	}
+}
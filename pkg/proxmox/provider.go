@@ -0,0 +1,550 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/ippool"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
+)
+
+func NewProvider(logs log.Logger) (*ProxmoxProvider, error) {
+	providerConfig, err := options.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ResolveVmId(providerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// with auto the id is only known once create allocated it
+	vmId := 0
+	if providerConfig.ProxmoxVmId != options.PROXMOX_VM_ID_AUTO {
+		vmId, err = strconv.Atoi(providerConfig.ProxmoxVmId)
+		if err != nil || vmId <= 0 {
+			return nil, fmt.Errorf(
+				"%s must be a positive integer or %s, got %s",
+				options.PROXMOX_VM_ID,
+				options.PROXMOX_VM_ID_AUTO,
+				providerConfig.ProxmoxVmId,
+			)
+		}
+	}
+
+	err = ippool.Resolve(providerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// create provider
+	provider := &ProxmoxProvider{
+		Config: providerConfig,
+		Log:    logs,
+		Client: NewClient(
+			providerConfig.ProxmoxApiUrl,
+			providerConfig.ProxmoxApiTokenId,
+			providerConfig.ProxmoxApiTokenSecret,
+			providerConfig.ProxmoxTlsInsecure,
+		),
+		VmId: vmId,
+	}
+	provider.Client.Retry = retry.Policy{
+		Attempts: providerConfig.RetryAttempts,
+		Timeout:  providerConfig.RetryTimeout,
+	}
+	provider.Client.Log = logs
+
+	return provider, nil
+}
+
+type ProxmoxProvider struct {
+	Config *options.Options
+	Log    log.Logger
+	Client *Client
+	VmId   int
+}
+
+func Create(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	node := providerProxmox.Config.NodeName
+
+	publicKeyBase, err := ssh.GetPublicKeyBase(providerProxmox.Config.MachineFolder)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(publicKeyBase)
+	if err != nil {
+		return err
+	}
+
+	err = AcquireVmId(ctx, providerProxmox.Client, providerProxmox.Config, providerProxmox.Log)
+	if err != nil {
+		return err
+	}
+
+	providerProxmox.VmId, err = strconv.Atoi(providerProxmox.Config.ProxmoxVmId)
+	if err != nil {
+		return err
+	}
+
+	err = ippool.Acquire(ctx, providerProxmox.Config, func() ([]string, error) {
+		return providerProxmox.Client.ConfiguredAddresses(ctx, providerProxmox.VmId)
+	}, providerProxmox.Log)
+	if err != nil {
+		return err
+	}
+
+	err = cloneTemplate(ctx, providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	upid, err := providerProxmox.Client.UpdateVMConfig(ctx, node, providerProxmox.VmId, vmConfig(providerProxmox, string(publicKey)))
+	if err != nil {
+		return err
+	}
+	err = providerProxmox.Client.WaitForTask(ctx, upid)
+	if err != nil {
+		return err
+	}
+
+	upid, err = providerProxmox.Client.ResizeVMDisk(ctx, node, providerProxmox.VmId, "scsi0", providerProxmox.Config.DiskSize+"G")
+	if err != nil {
+		return err
+	}
+	if upid != "" {
+		err = providerProxmox.Client.WaitForTask(ctx, upid)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = Start(ctx, providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	settings, err := connection.SettingsFromOptions(providerProxmox.Config)
+	if err != nil {
+		return err
+	}
+
+	// the first command of DevPod would race the boot otherwise
+	return connection.WaitForReady(
+		ctx,
+		providerProxmox.Config.MachineFolder,
+		settings,
+		providerProxmox.Config.ReadyTimeout,
+		HostKeySource(providerProxmox.Client),
+		providerProxmox.Log,
+	)
+}
+
+// cloneTemplate clones the template into the VM of the machine
+func cloneTemplate(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	node := providerProxmox.Config.NodeName
+
+	templateName := providerProxmox.Config.TemplateName
+	template, err := providerProxmox.Client.FindTemplate(ctx, templateName)
+	if err != nil {
+		return err
+	}
+
+	providerProxmox.Log.Infof("Cloning template %s into VM %d", templateName, providerProxmox.VmId)
+	upid, err := providerProxmox.Client.CloneVM(ctx, template.Node, template.VmId, providerProxmox.VmId, url.Values{
+		"name":        {providerProxmox.Config.CloudinitUsername + "-devbox"},
+		"description": {"DevPod development environment for " + providerProxmox.Config.CloudinitUsername},
+		"target":      {node},
+		"full":        {"1"},
+		"storage":     {providerProxmox.Config.DiskStorage},
+	})
+	if err != nil {
+		return err
+	}
+
+	return providerProxmox.Client.WaitForTask(ctx, upid)
+}
+
+// vmConfig returns the settings applied to a freshly cloned VM, in line
+// with examples/proxmox/main.tf
+func vmConfig(providerProxmox *ProxmoxProvider, publicKey string) url.Values {
+	config := providerProxmox.Config
+	sshKeys := strings.TrimSpace(config.CloudinitSshKey) + "\n" + strings.TrimSpace(publicKey)
+
+	net0 := "virtio,bridge=" + config.NetworkBridge
+	if config.VlanTag != "" {
+		net0 += ",tag=" + config.VlanTag
+	}
+
+	return url.Values{
+		"agent":      {"1"},
+		"ostype":     {"l26"},
+		"cores":      {config.VmCores},
+		"sockets":    {"1"},
+		"cpu":        {"host"},
+		"memory":     {config.VmMemory},
+		"scsihw":     {"virtio-scsi-pci"},
+		"ide2":       {config.DiskStorage + ":cloudinit"},
+		"vga":        {"std,memory=4"},
+		"net0":       {net0},
+		"serial0":    {"socket"},
+		"boot":       {"order=scsi0"},
+		"ipconfig0":  {ipConfig(config)},
+		"ciuser":     {config.CloudinitUsername},
+		"cipassword": {config.CloudinitPassword},
+		// the api expects the keys to be url encoded on top of the form
+		// encoding, with spaces as %20
+		"sshkeys": {strings.ReplaceAll(url.QueryEscape(sshKeys), "+", "%20")},
+	}
+}
+
+// ipConfig returns the cloudinit network configuration of the first nic
+func ipConfig(config *options.Options) string {
+	if config.CloudinitIp == options.CLOUDINIT_IP_DHCP {
+		return "ip=dhcp"
+	}
+
+	return "ip=" + config.CloudinitIp + ",gw=" + config.CloudinitGateway
+}
+
+func Delete(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	node := providerProxmox.Config.NodeName
+
+	if providerProxmox.VmId == 0 {
+		return release(ctx, providerProxmox)
+	}
+
+	status, err := providerProxmox.Client.GetVMStatus(ctx, node, providerProxmox.VmId)
+	if err != nil {
+		if IsNotFound(err) {
+			return release(ctx, providerProxmox)
+		}
+
+		return err
+	}
+
+	if status.Status != "stopped" {
+		upid, err := providerProxmox.Client.StopVM(ctx, node, providerProxmox.VmId)
+		if err != nil {
+			return err
+		}
+		err = providerProxmox.Client.WaitForTask(ctx, upid)
+		if err != nil {
+			return err
+		}
+	}
+
+	upid, err := providerProxmox.Client.DestroyVM(ctx, node, providerProxmox.VmId)
+	if err != nil {
+		return err
+	}
+	err = providerProxmox.Client.WaitForTask(ctx, upid)
+	if err != nil {
+		return err
+	}
+
+	return release(ctx, providerProxmox)
+}
+
+// release gives the address and id of a deleted VM back and forgets how
+// to reach it
+func release(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	err := connection.Remove(providerProxmox.Config.MachineFolder)
+	if err != nil {
+		return err
+	}
+
+	err = ippool.Release(ctx, providerProxmox.Config)
+	if err != nil {
+		return err
+	}
+
+	return ReleaseVmId(ctx, providerProxmox.Config)
+}
+
+// ensureVm fails for machines whose VMID is still to be allocated
+func ensureVm(providerProxmox *ProxmoxProvider) error {
+	if providerProxmox.VmId == 0 {
+		return fmt.Errorf("machine %s has no VM yet", providerProxmox.Config.MachineID)
+	}
+
+	return nil
+}
+
+func Start(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	err := ensureVm(providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	resumed, err := ResumeIfPaused(ctx, providerProxmox.Client, providerProxmox.Config.NodeName, providerProxmox.VmId)
+	if err != nil {
+		return err
+	}
+	if resumed {
+		return refreshConnection(ctx, providerProxmox)
+	}
+
+	upid, err := providerProxmox.Client.StartVM(ctx, providerProxmox.Config.NodeName, providerProxmox.VmId)
+	if err != nil {
+		return err
+	}
+	err = providerProxmox.Client.WaitForTask(ctx, upid)
+	if err != nil {
+		return err
+	}
+
+	return refreshConnection(ctx, providerProxmox)
+}
+
+func Stop(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	err := ensureVm(providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	// give the guest a minute to shut down cleanly before pulling the plug
+	upid, err := providerProxmox.Client.ShutdownVM(ctx, providerProxmox.Config.NodeName, providerProxmox.VmId, 60, true)
+	if err != nil {
+		return err
+	}
+
+	return providerProxmox.Client.WaitForTask(ctx, upid)
+}
+
+func Command(ctx context.Context, providerProxmox *ProxmoxProvider, command string) error {
+	err := ensureVm(providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	return RunCommand(
+		ctx,
+		providerProxmox.Client,
+		providerProxmox.Config,
+		command,
+		func() error {
+			settings, err := connection.SettingsFromOptions(providerProxmox.Config)
+			if err != nil {
+				return err
+			}
+
+			return connection.Command(
+				ctx,
+				providerProxmox.Config.MachineFolder,
+				settings,
+				func() (*connection.Record, error) {
+					return resolveConnection(ctx, providerProxmox)
+				},
+				command,
+				providerProxmox.Log,
+			)
+		},
+		func() (string, int, error) {
+			return providerProxmox.Config.NodeName, providerProxmox.VmId, nil
+		},
+		providerProxmox.Log,
+	)
+}
+
+// Console attaches stdin and stdout to the serial console of the VM
+func Console(
+	ctx context.Context,
+	providerProxmox *ProxmoxProvider,
+	stdin io.Reader,
+	stdout io.Writer,
+	cols int,
+	rows int,
+) error {
+	err := ensureVm(providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	return AttachConsole(
+		ctx,
+		providerProxmox.Client,
+		providerProxmox.Config.NodeName,
+		providerProxmox.VmId,
+		stdin,
+		stdout,
+		cols,
+		rows,
+	)
+}
+
+// Rekey pins the host keys of a rebuilt VM in place of the old ones
+func Rekey(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	err := ensureVm(providerProxmox)
+	if err != nil {
+		return err
+	}
+
+	record, err := connection.Refresh(providerProxmox.Config.MachineFolder, func() (*connection.Record, error) {
+		return resolveConnection(ctx, providerProxmox)
+	})
+	if err != nil {
+		return err
+	}
+
+	settings, err := connection.SettingsFromOptions(providerProxmox.Config)
+	if err != nil {
+		return err
+	}
+
+	return connection.Rekey(
+		ctx,
+		providerProxmox.Config.MachineFolder,
+		record,
+		settings,
+		HostKeySource(providerProxmox.Client),
+		providerProxmox.Log,
+	)
+}
+
+// resolveConnection works out how to reach the machine, asking the guest
+// agent with dhcp
+func resolveConnection(ctx context.Context, providerProxmox *ProxmoxProvider) (*connection.Record, error) {
+	externalIP, err := GuestAddress(
+		ctx,
+		providerProxmox.Client,
+		providerProxmox.Config,
+		providerProxmox.Config.NodeName,
+		providerProxmox.VmId,
+		providerProxmox.Log,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connection.Record{
+		Host: externalIP,
+		Port: SshPort(providerProxmox.Config),
+		User: SshUser(providerProxmox.Config),
+		VmId: providerProxmox.VmId,
+		Node: providerProxmox.Config.NodeName,
+	}, nil
+}
+
+// SshUser returns the user to log in as, the cloudinit user unless
+// SSH_USER is set
+func SshUser(config *options.Options) string {
+	if config.SshUser != "" {
+		return config.SshUser
+	}
+
+	return config.CloudinitUsername
+}
+
+// SshPort returns the port sshd listens on, 22 unless SSH_PORT is set
+func SshPort(config *options.Options) int {
+	if config.SshPort != 0 {
+		return config.SshPort
+	}
+
+	return 22
+}
+
+// refreshConnection stores how to reach the machine for later commands
+func refreshConnection(ctx context.Context, providerProxmox *ProxmoxProvider) error {
+	_, err := connection.Refresh(providerProxmox.Config.MachineFolder, func() (*connection.Record, error) {
+		return resolveConnection(ctx, providerProxmox)
+	})
+	return err
+}
+
+func Status(ctx context.Context, providerProxmox *ProxmoxProvider) (client.Status, error) {
+	if providerProxmox.VmId == 0 {
+		return client.StatusNotFound, nil
+	}
+
+	status, err := providerProxmox.Client.GetVMStatus(
+		ctx,
+		providerProxmox.Config.NodeName,
+		providerProxmox.VmId,
+	)
+	if err != nil {
+		if IsNotFound(err) {
+			return client.StatusNotFound, nil
+		}
+
+		return client.StatusNotFound, err
+	}
+
+	return StatusFromVM(status), nil
+}
+
+// StatusFromVM maps the runtime state of a guest onto a DevPod status
+func StatusFromVM(status *VMStatus) client.Status {
+	switch status.Lock {
+	case "":
+	case "suspended":
+		// hibernated to disk, a start resumes it
+		return client.StatusStopped
+	default:
+		// a clone, migration, backup or similar is in progress
+		return client.StatusBusy
+	}
+
+	switch status.Status {
+	case "running":
+		// paused guests still count as running for proxmox
+		if status.QmpStatus != "" && status.QmpStatus != "running" {
+			return client.StatusStopped
+		}
+
+		return client.StatusRunning
+	case "stopped":
+		return client.StatusStopped
+	}
+
+	return client.StatusBusy
+}
+
+// ResumeIfPaused resumes a guest that is paused or suspended in memory and
+// reports whether it did so
+func ResumeIfPaused(ctx context.Context, proxmoxClient *Client, node string, vmid int) (bool, error) {
+	status, err := proxmoxClient.GetVMStatus(ctx, node, vmid)
+	if err != nil {
+		return false, err
+	}
+
+	if status.Status != "running" || status.QmpStatus == "" || status.QmpStatus == "running" {
+		return false, nil
+	}
+
+	upid, err := proxmoxClient.ResumeVM(ctx, node, vmid)
+	if err != nil {
+		return false, err
+	}
+
+	return true, proxmoxClient.WaitForTask(ctx, upid)
+}
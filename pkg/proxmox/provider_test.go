@@ -0,0 +1,248 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+func TestStatusFromVM(t *testing.T) {
+	tests := []struct {
+		status   VMStatus
+		expected client.Status
+	}{
+		{VMStatus{Status: "running", QmpStatus: "running"}, client.StatusRunning},
+		{VMStatus{Status: "running"}, client.StatusRunning},
+		{VMStatus{Status: "running", QmpStatus: "paused"}, client.StatusStopped},
+		{VMStatus{Status: "running", QmpStatus: "suspended"}, client.StatusStopped},
+		{VMStatus{Status: "stopped", QmpStatus: "stopped"}, client.StatusStopped},
+		{VMStatus{Status: "stopped", Lock: "suspended"}, client.StatusStopped},
+		{VMStatus{Status: "stopped", Lock: "clone"}, client.StatusBusy},
+		{VMStatus{Status: "running", QmpStatus: "running", Lock: "backup"}, client.StatusBusy},
+		{VMStatus{Status: "unknown"}, client.StatusBusy},
+	}
+
+	for _, test := range tests {
+		status := StatusFromVM(&test.status)
+		if status != test.expected {
+			t.Errorf("expected %+v to be %s, got %s", test.status, test.expected, status)
+		}
+	}
+}
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func newTestProvider(t *testing.T, proxmoxClient *Client) *ProxmoxProvider {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+
+	return &ProxmoxProvider{
+		Config: &options.Options{
+			MachineID:         "devpod-test",
+			MachineFolder:     t.TempDir(),
+			NodeName:          "pve",
+			ProxmoxVmId:       options.PROXMOX_VM_ID_AUTO,
+			VmIdRange:         "200-299",
+			TemplateName:      "ubuntu",
+			DiskStorage:       "local-lvm",
+			DiskSize:          "20",
+			VmCores:           "2",
+			VmMemory:          "2048",
+			NetworkBridge:     "vmbr0",
+			CloudinitUsername: "devpod",
+			CloudinitIp:       "127.0.0.1/24",
+			CloudinitGateway:  "127.0.0.254",
+			ReadyTimeout:      100 * time.Millisecond,
+			SshPort:           closedPort(t),
+		},
+		Log:    log.Default,
+		Client: proxmoxClient,
+	}
+}
+
+// handleTask lets the task identified by upid finish successfully
+func (a *fakeApi) handleTask(upid string) string {
+	a.handle(taskRoute(upid), `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+	return `{"data":"` + upid + `"}`
+}
+
+// apiCalls returns the calls other than task polling
+func (a *fakeApi) apiCalls() []string {
+	calls := []string{}
+	for _, call := range a.called() {
+		if !strings.Contains(call, "/tasks/") {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+func TestCreate(t *testing.T) {
+	api, proxmoxClient := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[
+		{"id":"qemu/200","type":"qemu","node":"pve","vmid":200,"name":"other"},
+		{"id":"qemu/9000","type":"qemu","node":"pve2","vmid":9000,"name":"ubuntu","template":1}
+	]}`)
+	api.handle("POST /nodes/pve2/qemu/9000/clone", api.handleTask("UPID:pve2:1:1:1:qmclone:9000:devpod@pve!test:"))
+	api.handle("POST /nodes/pve/qemu/201/config", api.handleTask("UPID:pve:2:2:2:qmconfig:201:devpod@pve!test:"))
+	// older versions resize without a task
+	api.handle("PUT /nodes/pve/qemu/201/resize", `{"data":null}`)
+	api.handle("GET /nodes/pve/qemu/201/status/current", `{"data":{"status":"stopped","qmpstatus":"stopped"}}`)
+	api.handle("POST /nodes/pve/qemu/201/status/start", api.handleTask("UPID:pve:3:3:3:qmstart:201:devpod@pve!test:"))
+
+	provider := newTestProvider(t, proxmoxClient)
+	err := Create(context.Background(), provider)
+	if err == nil || !strings.Contains(err.Error(), "SSH") {
+		t.Fatalf("expected create to end waiting for SSH, got %v", err)
+	}
+
+	expected := []string{
+		"GET /cluster/resources",
+		"GET /cluster/resources",
+		"POST /nodes/pve2/qemu/9000/clone",
+		"POST /nodes/pve/qemu/201/config",
+		"PUT /nodes/pve/qemu/201/resize",
+		"GET /nodes/pve/qemu/201/status/current",
+		"POST /nodes/pve/qemu/201/status/start",
+	}
+	if calls := api.apiCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(calls, "\n"))
+	}
+
+	tasks := 0
+	for _, call := range api.called() {
+		if strings.Contains(call, "/tasks/") {
+			tasks++
+		}
+	}
+	if tasks != 3 {
+		t.Errorf("expected the clone, config and start tasks to be waited for, got %d polls", tasks)
+	}
+
+	clone := api.forms["POST /nodes/pve2/qemu/9000/clone"]
+	if clone.Get("newid") != "201" || clone.Get("target") != "pve" || clone.Get("full") != "1" || clone.Get("storage") != "local-lvm" {
+		t.Errorf("unexpected clone parameters %v", clone)
+	}
+
+	config := api.forms["POST /nodes/pve/qemu/201/config"]
+	if config.Get("ipconfig0") != "ip=127.0.0.1/24,gw=127.0.0.254" || config.Get("net0") != "virtio,bridge=vmbr0" {
+		t.Errorf("unexpected config parameters %v", config)
+	}
+	if !strings.Contains(config.Get("sshkeys"), "ssh-rsa%20") {
+		t.Errorf("expected the DevPod key to be url encoded in sshkeys, got %q", config.Get("sshkeys"))
+	}
+
+	resize := api.forms["PUT /nodes/pve/qemu/201/resize"]
+	if resize.Get("disk") != "scsi0" || resize.Get("size") != "20G" {
+		t.Errorf("unexpected resize parameters %v", resize)
+	}
+
+	if provider.VmId != 201 || provider.Config.ProxmoxVmId != "201" {
+		t.Errorf("expected VMID 201 to be allocated, got %d", provider.VmId)
+	}
+
+	record, err := connection.Load(provider.Config.MachineFolder)
+	if err != nil || record == nil {
+		t.Fatalf("expected the connection to be stored, got %v", err)
+	}
+	if record.Host != "127.0.0.1" || record.User != "devpod" || record.VmId != 201 || record.Node != "pve" {
+		t.Errorf("unexpected connection %+v", record)
+	}
+}
+
+func TestCreateTaskFailure(t *testing.T) {
+	api, proxmoxClient := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[{"id":"qemu/9000","type":"qemu","node":"pve","vmid":9000,"name":"ubuntu","template":1}]}`)
+	upid := "UPID:pve:1:1:1:qmclone:9000:devpod@pve!test:"
+	api.handle("POST /nodes/pve/qemu/9000/clone", `{"data":"`+upid+`"}`)
+	api.handle(taskRoute(upid), `{"data":{"status":"stopped","exitstatus":"storage 'local-lvm' does not have enough space"}}`)
+
+	err := Create(context.Background(), newTestProvider(t, proxmoxClient))
+	if err == nil || !strings.Contains(err.Error(), "not have enough space") {
+		t.Fatalf("expected the failed clone task to be returned, got %v", err)
+	}
+
+	for _, call := range api.called() {
+		if strings.HasSuffix(call, "/config") || strings.HasSuffix(call, "/start") {
+			t.Errorf("expected create to stop after the failed clone, got %s", call)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	api, proxmoxClient := newFakeApi(t)
+	api.handle("GET /nodes/pve/qemu/200/status/current", `{"data":{"status":"running","qmpstatus":"running"}}`)
+	api.handle("POST /nodes/pve/qemu/200/status/stop", api.handleTask("UPID:pve:1:1:1:qmstop:200:devpod@pve!test:"))
+	api.handle("DELETE /nodes/pve/qemu/200", api.handleTask("UPID:pve:2:2:2:qmdestroy:200:devpod@pve!test:"))
+
+	provider := newTestProvider(t, proxmoxClient)
+	provider.VmId = 200
+	provider.Config.ProxmoxVmId = strconv.Itoa(provider.VmId)
+	err := Delete(context.Background(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /nodes/pve/qemu/200/status/current",
+		"POST /nodes/pve/qemu/200/status/stop",
+		"DELETE /nodes/pve/qemu/200",
+	}
+	if calls := api.apiCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, calls)
+	}
+
+	destroy := api.forms["DELETE /nodes/pve/qemu/200"]
+	if destroy.Get("purge") != "1" {
+		t.Errorf("expected the VM to be purged, got %v", destroy)
+	}
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	api, proxmoxClient := newFakeApi(t)
+
+	provider := newTestProvider(t, proxmoxClient)
+	provider.VmId = 200
+	err := Delete(context.Background(), provider)
+	if err != nil {
+		t.Fatalf("expected deleting a vanished VM to succeed, got %v", err)
+	}
+
+	if calls := api.apiCalls(); len(calls) != 1 {
+		t.Fatalf("expected only the status to be read, got %v", calls)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Resource is an entry of the cluster wide resource list
+type Resource struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Node     string `json:"node"`
+	VmId     int    `json:"vmid"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Template int    `json:"template"`
+}
+
+// VMStatus is the runtime state of a QEMU guest
+type VMStatus struct {
+	Status    string `json:"status"`
+	QmpStatus string `json:"qmpstatus"`
+	Lock      string `json:"lock"`
+	Name      string `json:"name"`
+}
+
+func vmPath(node string, vmid int) string {
+	return "/nodes/" + url.PathEscape(node) + "/qemu/" + strconv.Itoa(vmid)
+}
+
+// Resources lists the cluster resources of the given type (vm, node, storage, ...)
+func (c *Client) Resources(ctx context.Context, resourceType string) ([]Resource, error) {
+	query := url.Values{}
+	if resourceType != "" {
+		query.Set("type", resourceType)
+	}
+
+	resources := []Resource{}
+	err := c.Get(ctx, "/cluster/resources", query, &resources)
+	if err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// FindTemplate looks up a QEMU template by name anywhere in the cluster
+func (c *Client) FindTemplate(ctx context.Context, name string) (*Resource, error) {
+	resources, err := c.Resources(ctx, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resources {
+		if resources[i].Type == "qemu" && resources[i].Template == 1 && resources[i].Name == name {
+			return &resources[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("template %s not found", name)
+}
+
+// CloneVM clones vmid into newid and returns the id of the clone task
+func (c *Client) CloneVM(ctx context.Context, node string, vmid, newid int, params url.Values) (string, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("newid", strconv.Itoa(newid))
+
+	var upid string
+	err := c.Post(ctx, vmPath(node, vmid)+"/clone", params, &upid)
+	return upid, err
+}
+
+// GetVMConfig returns the current configuration of a guest
+func (c *Client) GetVMConfig(ctx context.Context, node string, vmid int) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	err := c.Get(ctx, vmPath(node, vmid)+"/config", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// UpdateVMConfig changes the configuration of a guest and returns the id
+// of the update task
+func (c *Client) UpdateVMConfig(ctx context.Context, node string, vmid int, params url.Values) (string, error) {
+	var upid string
+	err := c.Post(ctx, vmPath(node, vmid)+"/config", params, &upid)
+	return upid, err
+}
+
+// ResizeVMDisk sets the size of a disk, e.g. 100G. Older Proxmox versions
+// resize synchronously and return no task id.
+func (c *Client) ResizeVMDisk(ctx context.Context, node string, vmid int, disk, size string) (string, error) {
+	var upid string
+	err := c.Put(ctx, vmPath(node, vmid)+"/resize", url.Values{
+		"disk": {disk},
+		"size": {size},
+	}, &upid)
+	return upid, err
+}
+
+// GetVMStatus returns the runtime state of a guest
+func (c *Client) GetVMStatus(ctx context.Context, node string, vmid int) (*VMStatus, error) {
+	status := &VMStatus{}
+	err := c.Get(ctx, vmPath(node, vmid)+"/status/current", nil, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// StartVM powers on a guest
+func (c *Client) StartVM(ctx context.Context, node string, vmid int) (string, error) {
+	return c.vmAction(ctx, node, vmid, "start", nil)
+}
+
+// ResumeVM continues a paused guest
+func (c *Client) ResumeVM(ctx context.Context, node string, vmid int) (string, error) {
+	return c.vmAction(ctx, node, vmid, "resume", nil)
+}
+
+// StopVM powers off a guest immediately
+func (c *Client) StopVM(ctx context.Context, node string, vmid int) (string, error) {
+	return c.vmAction(ctx, node, vmid, "stop", nil)
+}
+
+// ShutdownVM asks the guest to shut down through ACPI or the guest agent.
+// With forceStop the guest is powered off once timeout seconds have passed.
+func (c *Client) ShutdownVM(ctx context.Context, node string, vmid int, timeout int, forceStop bool) (string, error) {
+	params := url.Values{}
+	if timeout > 0 {
+		params.Set("timeout", strconv.Itoa(timeout))
+	}
+	if forceStop {
+		params.Set("forceStop", "1")
+	}
+
+	return c.vmAction(ctx, node, vmid, "shutdown", params)
+}
+
+// DestroyVM removes a guest together with its disks
+func (c *Client) DestroyVM(ctx context.Context, node string, vmid int) (string, error) {
+	var upid string
+	err := c.Delete(ctx, vmPath(node, vmid), url.Values{
+		"purge":                      {"1"},
+		"destroy-unreferenced-disks": {"1"},
+	}, &upid)
+	return upid, err
+}
+
+func (c *Client) vmAction(ctx context.Context, node string, vmid int, action string, params url.Values) (string, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+
+	var upid string
+	err := c.Post(ctx, vmPath(node, vmid)+"/status/"+action, params, &upid)
+	return upid, err
+}
+
+// ConfiguredAddresses returns the static addresses configured on the
+// guests of the cluster, through ipconfigN for QEMU VMs and netN for
+// containers. Templates are skipped, as are guests listed in skip.
+func (c *Client) ConfiguredAddresses(ctx context.Context, skip ...int) ([]string, error) {
+	resources, err := c.Resources(ctx, "vm")
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, resource := range resources {
+		if resource.Template == 1 || containsInt(skip, resource.VmId) {
+			continue
+		}
+
+		path := vmPath(resource.Node, resource.VmId)
+		prefix := "ipconfig"
+		if resource.Type == "lxc" {
+			path = "/nodes/" + url.PathEscape(resource.Node) + "/lxc/" + strconv.Itoa(resource.VmId)
+			prefix = "net"
+		} else if resource.Type != "qemu" {
+			continue
+		}
+
+		config := map[string]interface{}{}
+		err := c.Get(ctx, path+"/config", nil, &config)
+		if err != nil {
+			// the guest vanished while we were looking
+			if IsNotFound(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for key, value := range config {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			setting, _ := value.(string)
+			for _, field := range strings.Split(setting, ",") {
+				address, ok := strings.CutPrefix(field, "ip=")
+				if !ok || address == "dhcp" || address == "manual" {
+					continue
+				}
+
+				addresses = append(addresses, strings.Split(address, "/")[0])
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
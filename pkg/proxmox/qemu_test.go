@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConfiguredAddresses(t *testing.T) {
+	api, client := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[
+		{"id":"qemu/100","type":"qemu","node":"pve","vmid":100,"name":"static"},
+		{"id":"qemu/101","type":"qemu","node":"pve","vmid":101,"name":"dhcp"},
+		{"id":"lxc/102","type":"lxc","node":"pve2","vmid":102,"name":"container"},
+		{"id":"qemu/103","type":"qemu","node":"pve","vmid":103,"name":"vanished"},
+		{"id":"qemu/104","type":"qemu","node":"pve","vmid":104,"name":"self"},
+		{"id":"qemu/9000","type":"qemu","node":"pve","vmid":9000,"name":"template","template":1}
+	]}`)
+	api.handle("GET /nodes/pve/qemu/100/config", `{"data":{
+		"ipconfig0":"ip=10.0.0.10/24,gw=10.0.0.1",
+		"ipconfig1":"ip6=fd00::10/64,ip=192.168.1.10/24",
+		"net0":"virtio=BC:24:11:00:00:01,bridge=vmbr0,ip=10.9.9.9"
+	}}`)
+	api.handle("GET /nodes/pve/qemu/101/config", `{"data":{"ipconfig0":"ip=dhcp","ipconfig1":"ip=manual"}}`)
+	api.handle("GET /nodes/pve2/lxc/102/config", `{"data":{
+		"net0":"name=eth0,bridge=vmbr0,ip=10.0.0.20/24,gw=10.0.0.1",
+		"ipconfig0":"ip=10.8.8.8/24"
+	}}`)
+	api.handle("GET /nodes/pve/qemu/104/config", `{"data":{"ipconfig0":"ip=10.0.0.40/24"}}`)
+	api.handle("GET /nodes/pve/qemu/9000/config", `{"data":{"ipconfig0":"ip=10.0.0.90/24"}}`)
+
+	addresses, err := client.ConfiguredAddresses(context.Background(), 104)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(addresses)
+	expected := []string{"10.0.0.10", "10.0.0.20", "192.168.1.10"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("expected %v, got %v", expected, addresses)
+	}
+
+	if api.forms["GET /cluster/resources"].Get("type") != "vm" {
+		t.Errorf("expected only guests to be listed, got %v", api.forms["GET /cluster/resources"])
+	}
+	for _, call := range api.called() {
+		if call == "GET /nodes/pve/qemu/9000/config" || call == "GET /nodes/pve/qemu/104/config" {
+			t.Errorf("expected templates and skipped guests not to be read, got %s", call)
+		}
+	}
+}
+
+func TestConfiguredAddressesError(t *testing.T) {
+	api, client := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[{"id":"qemu/100","type":"qemu","node":"pve","vmid":100}]}`)
+	api.handleFunc("GET /nodes/pve/qemu/100/config", func(url.Values) fakeReply {
+		return fakeReply{Code: 403, Reason: "Permission check failed", Body: `{"data":null}`}
+	})
+
+	_, err := client.ConfiguredAddresses(context.Background())
+	if err == nil {
+		t.Fatal("expected errors other than vanished guests to be returned")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TaskPollInterval is how often WaitForTask asks for the state of a task
+var TaskPollInterval = time.Second
+
+// TaskStatus is the state of a worker task identified by its UPID
+type TaskStatus struct {
+	Status     string `json:"status"`
+	ExitStatus string `json:"exitstatus"`
+	Type       string `json:"type"`
+	Node       string `json:"node"`
+}
+
+// TaskNode returns the node a task runs on, which is the second field of
+// its UPID (UPID:node:pid:pstart:starttime:type:id:user:)
+func TaskNode(upid string) (string, error) {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 3 || parts[0] != "UPID" || parts[1] == "" {
+		return "", fmt.Errorf("malformed task id %q", upid)
+	}
+
+	return parts[1], nil
+}
+
+// GetTaskStatus returns the current state of a task
+func (c *Client) GetTaskStatus(ctx context.Context, upid string) (*TaskStatus, error) {
+	node, err := TaskNode(upid)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TaskStatus{}
+	err = c.Get(ctx, "/nodes/"+node+"/tasks/"+url.PathEscape(upid)+"/status", nil, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// WaitForTask polls a task until it has finished and returns an error if
+// it did not end successfully
+func (c *Client) WaitForTask(ctx context.Context, upid string) error {
+	ticker := time.NewTicker(TaskPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status, err := c.GetTaskStatus(ctx, upid)
+		if err != nil {
+			return err
+		}
+
+		if status.Status == "stopped" {
+			// tasks that only emitted warnings still did their job
+			if status.ExitStatus == "OK" || strings.HasPrefix(status.ExitStatus, "WARNINGS") {
+				return nil
+			}
+
+			return fmt.Errorf("task %s failed: %s", upid, status.ExitStatus)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const cloneTask = "UPID:pve:000A1B2C:0153F2A1:65A0B1C2:qmclone:9000:devpod@pve!test:"
+
+func TestTaskNode(t *testing.T) {
+	node, err := TaskNode(cloneTask)
+	if err != nil || node != "pve" {
+		t.Fatalf("expected node pve, got %q, %v", node, err)
+	}
+
+	for _, upid := range []string{"", "pve", "TASK:pve:1", "UPID::1:"} {
+		_, err := TaskNode(upid)
+		if err == nil {
+			t.Errorf("expected %q to be malformed", upid)
+		}
+	}
+}
+
+func TestWaitForTask(t *testing.T) {
+	tests := []struct {
+		name       string
+		exitStatus string
+		failure    string
+	}{
+		{name: "ok", exitStatus: "OK"},
+		{name: "warnings", exitStatus: "WARNINGS: 2"},
+		{name: "failed", exitStatus: "unable to create VM 100 - disk full", failure: "disk full"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, client := newFakeApi(t)
+
+			polls := 0
+			api.handleFunc(taskRoute(cloneTask), func(url.Values) fakeReply {
+				polls++
+				if polls < 3 {
+					return fakeReply{Code: 200, Body: `{"data":{"status":"running","type":"qmclone","node":"pve"}}`}
+				}
+
+				return fakeReply{Code: 200, Body: `{"data":{"status":"stopped","exitstatus":"` + test.exitStatus + `"}}`}
+			})
+
+			err := client.WaitForTask(context.Background(), cloneTask)
+			if polls != 3 {
+				t.Errorf("expected the task to be polled until it stopped, got %d polls", polls)
+			}
+
+			if test.failure == "" {
+				if err != nil {
+					t.Fatalf("expected the task to succeed, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.failure) {
+				t.Fatalf("expected the task to fail with %q, got %v", test.failure, err)
+			}
+		})
+	}
+}
+
+func TestWaitForTaskNotFound(t *testing.T) {
+	_, client := newFakeApi(t)
+
+	err := client.WaitForTask(context.Background(), cloneTask)
+	if !IsNotFound(err) {
+		t.Fatalf("expected an unknown task to be not found, got %v", err)
+	}
+}
+
+func TestWaitForTaskCancel(t *testing.T) {
+	api, client := newFakeApi(t)
+	api.handle(taskRoute(cloneTask), `{"data":{"status":"running"}}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := client.WaitForTask(ctx, cloneTask)
+	if err == nil {
+		t.Fatal("expected waiting to stop with the context")
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+const (
+	vmIdFile         = "vmid.json"
+	vmIdRegistryName = "vmids"
+)
+
+// VmIdRecord is the VMID allocated to a machine
+type VmIdRecord struct {
+	VmId    int       `json:"vmid"`
+	Created time.Time `json:"created"`
+}
+
+// NextVmId returns the next free VMID of the cluster
+func (c *Client) NextVmId(ctx context.Context) (int, error) {
+	// depending on the version the id is returned as number or string
+	var nextId interface{}
+	err := c.Get(ctx, "/cluster/nextid", nil, &nextId)
+	if err != nil {
+		return 0, err
+	}
+
+	switch id := nextId.(type) {
+	case float64:
+		return int(id), nil
+	case string:
+		return strconv.Atoi(id)
+	}
+
+	return 0, fmt.Errorf("unexpected next vmid %v", nextId)
+}
+
+// ParseVmIdRange parses a range like 9000-9999
+func ParseVmIdRange(vmIdRange string) (int, int, error) {
+	from, to, ok := strings.Cut(vmIdRange, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("vmid range %s must look like 9000-9999", vmIdRange)
+	}
+
+	first, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("vmid range %s must look like 9000-9999", vmIdRange)
+	}
+
+	last, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, fmt.Errorf("vmid range %s must look like 9000-9999", vmIdRange)
+	}
+
+	// proxmox only accepts ids from 100 on
+	if first < 100 || last < first {
+		return 0, 0, fmt.Errorf("invalid vmid range %s", vmIdRange)
+	}
+
+	return first, last, nil
+}
+
+// ResolveVmId replaces auto in config with the VMID allocated to the
+// machine, if it already has one
+func ResolveVmId(config *options.Options) error {
+	if config.ProxmoxVmId != options.PROXMOX_VM_ID_AUTO {
+		return nil
+	}
+
+	record, err := loadVmId(config.MachineFolder)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		config.ProxmoxVmId = strconv.Itoa(record.VmId)
+	}
+
+	return nil
+}
+
+// AcquireVmId allocates a free VMID to the machine if config asks for auto
+// and persists it in the machine folder. Without VMID_RANGE the search
+// starts at the next id proposed by the cluster. Ids handed out from this
+// host but not created yet are skipped, so concurrent creates never get
+// the same id.
+func AcquireVmId(ctx context.Context, proxmoxClient *Client, config *options.Options, logs log.Logger) error {
+	if config.ProxmoxVmId != options.PROXMOX_VM_ID_AUTO {
+		return nil
+	}
+
+	record, err := loadVmId(config.MachineFolder)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		config.ProxmoxVmId = strconv.Itoa(record.VmId)
+		return nil
+	}
+
+	first, last := 0, 999999999
+	if config.VmIdRange != "" {
+		first, last, err = ParseVmIdRange(config.VmIdRange)
+		if err != nil {
+			return err
+		}
+	} else {
+		first, err = proxmoxClient.NextVmId(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = registry.Update(ctx, vmIdRegistryName, func(vmIds map[string]string) error {
+		resources, err := proxmoxClient.Resources(ctx, "vm")
+		if err != nil {
+			return err
+		}
+
+		used := map[int]bool{}
+		for _, resource := range resources {
+			used[resource.VmId] = true
+		}
+		for vmId := range vmIds {
+			id, err := strconv.Atoi(vmId)
+			if err == nil {
+				used[id] = true
+			}
+		}
+
+		for id := first; id <= last; id++ {
+			if used[id] {
+				continue
+			}
+
+			record = &VmIdRecord{VmId: id, Created: time.Now()}
+			vmIds[strconv.Itoa(id)] = config.MachineID
+			return registry.WriteJSON(filepath.Join(config.MachineFolder, vmIdFile), record)
+		}
+
+		return fmt.Errorf("no free vmid left in range %d-%d", first, last)
+	})
+	if err != nil {
+		return err
+	}
+
+	logs.Infof("Allocated VMID %d", record.VmId)
+	config.ProxmoxVmId = strconv.Itoa(record.VmId)
+	return nil
+}
+
+// ReleaseVmId forgets the VMID allocated to the machine
+func ReleaseVmId(ctx context.Context, config *options.Options) error {
+	record, err := loadVmId(config.MachineFolder)
+	if err != nil || record == nil {
+		return err
+	}
+
+	err = registry.Update(ctx, vmIdRegistryName, func(vmIds map[string]string) error {
+		for vmId, machineID := range vmIds {
+			if machineID == config.MachineID {
+				delete(vmIds, vmId)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(config.MachineFolder, vmIdFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func loadVmId(machineFolder string) (*VmIdRecord, error) {
+	record := &VmIdRecord{}
+	err := registry.ReadJSON(filepath.Join(machineFolder, vmIdFile), record)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return record, nil
+}
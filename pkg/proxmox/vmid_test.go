@@ -0,0 +1,135 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxmox
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+func newVmIdConfig(t *testing.T, machineID string) *options.Options {
+	return &options.Options{
+		MachineID:     machineID,
+		MachineFolder: t.TempDir(),
+		ProxmoxVmId:   options.PROXMOX_VM_ID_AUTO,
+	}
+}
+
+func TestAcquireVmId(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	api, client := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[
+		{"id":"qemu/9000","type":"qemu","node":"pve","vmid":9000},
+		{"id":"lxc/9001","type":"lxc","node":"pve","vmid":9001}
+	]}`)
+
+	first := newVmIdConfig(t, "devpod-first")
+	first.VmIdRange = "9000-9003"
+	err := AcquireVmId(context.Background(), client, first, log.Default)
+	if err != nil || first.ProxmoxVmId != "9002" {
+		t.Fatalf("expected the first free id 9002, got %q, %v", first.ProxmoxVmId, err)
+	}
+
+	// an id handed out but not created yet is skipped
+	second := newVmIdConfig(t, "devpod-second")
+	second.VmIdRange = "9000-9003"
+	err = AcquireVmId(context.Background(), client, second, log.Default)
+	if err != nil || second.ProxmoxVmId != "9003" {
+		t.Fatalf("expected id 9003, got %q, %v", second.ProxmoxVmId, err)
+	}
+
+	third := newVmIdConfig(t, "devpod-third")
+	third.VmIdRange = "9000-9003"
+	err = AcquireVmId(context.Background(), client, third, log.Default)
+	if err == nil {
+		t.Fatalf("expected the range to be exhausted, got %q", third.ProxmoxVmId)
+	}
+
+	// the allocated id is kept across invocations
+	first.ProxmoxVmId = options.PROXMOX_VM_ID_AUTO
+	err = ResolveVmId(first)
+	if err != nil || first.ProxmoxVmId != "9002" {
+		t.Fatalf("expected the stored id 9002, got %q, %v", first.ProxmoxVmId, err)
+	}
+
+	err = ReleaseVmId(context.Background(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := registry.GetDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmIds := map[string]string{}
+	err = registry.ReadJSON(filepath.Join(dir, vmIdRegistryName+".json"), &vmIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vmIds) != 1 || vmIds["9003"] != "devpod-second" {
+		t.Fatalf("expected only 9003 to stay allocated, got %v", vmIds)
+	}
+
+	err = AcquireVmId(context.Background(), client, third, log.Default)
+	if err != nil || third.ProxmoxVmId != "9002" {
+		t.Fatalf("expected the released id 9002, got %q, %v", third.ProxmoxVmId, err)
+	}
+}
+
+func TestAcquireVmIdNextId(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	api, client := newFakeApi(t)
+	api.handle("GET /cluster/resources", `{"data":[{"id":"qemu/105","type":"qemu","node":"pve","vmid":105}]}`)
+	// older versions return the id as string
+	api.handle("GET /cluster/nextid", `{"data":"105"}`)
+
+	config := newVmIdConfig(t, "devpod-next")
+	err := AcquireVmId(context.Background(), client, config, log.Default)
+	if err != nil || config.ProxmoxVmId != "106" {
+		t.Fatalf("expected id 106, got %q, %v", config.ProxmoxVmId, err)
+	}
+}
+
+func TestAcquireVmIdFixed(t *testing.T) {
+	_, client := newFakeApi(t)
+
+	config := newVmIdConfig(t, "devpod-fixed")
+	config.ProxmoxVmId = "123"
+	err := AcquireVmId(context.Background(), client, config, log.Default)
+	if err != nil || config.ProxmoxVmId != "123" {
+		t.Fatalf("expected a fixed id to be kept, got %q, %v", config.ProxmoxVmId, err)
+	}
+}
+
+func TestParseVmIdRange(t *testing.T) {
+	first, last, err := ParseVmIdRange(" 9000 - 9999 ")
+	if err != nil || first != 9000 || last != 9999 {
+		t.Fatalf("expected 9000-9999, got %d-%d, %v", first, last, err)
+	}
+
+	for _, vmIdRange := range []string{"9000", "a-b", "99-200", "200-100"} {
+		_, _, err := ParseVmIdRange(vmIdRange)
+		if err == nil {
+			t.Errorf("expected %q to be invalid", vmIdRange)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/config"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+)
+
+// LockTimeout is how long to wait for another process to finish updating
+// a registry
+var LockTimeout = 2 * time.Minute
+
+// GetDir returns where the provider keeps state shared by all machines of
+// this host
+func GetDir() (string, error) {
+	devpodPath, err := config.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(devpodPath, "proxmox"), nil
+}
+
+// Update loads the registry with the given name, passes it to update and
+// saves the result. Registries map a resource, e.g. an address, to the
+// machine holding it. Updates are serialized across processes.
+func Update(ctx context.Context, name string, update func(entries map[string]string) error) error {
+	dir, err := GetDir()
+	if err != nil {
+		return err
+	}
+
+	registryLock, err := lock.Acquire(ctx, filepath.Join(dir, name+".lock"), "update of "+name, LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer registryLock.Release()
+
+	entries := map[string]string{}
+	err = ReadJSON(filepath.Join(dir, name+".json"), &entries)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = update(entries)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(filepath.Join(dir, name+".json"), entries)
+}
+
+// ReadJSON decodes the file at path into value
+func ReadJSON(path string, value interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(content, value)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// WriteJSON replaces path atomically so readers never see partial files
+func WriteJSON(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+)
+
+// BaseDelay is the wait before the first retry, doubled for every further one
+var BaseDelay = 2 * time.Second
+
+// MaxDelay caps the wait between two attempts
+var MaxDelay = 30 * time.Second
+
+// transientErrors are what a call reports when it couldn't reach the
+// Proxmox API, e.g. while pveproxy restarts or a cluster node is briefly
+// unreachable. Lock errors are left out on purpose: "is locked" and "got
+// timeout" are reported by terraform state locks as well as by Proxmox
+// tasks that stopped halfway through a clone or a resize.
+var transientErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"tls handshake timeout",
+	"502 bad gateway",
+	"503 service unavailable",
+	"596 connection timed out",
+}
+
+// stateLockError is how terraform reports that another run holds the
+// state. It waited for the lock for -lock-timeout already.
+const stateLockError = "error acquiring the state lock"
+
+// now and after are the clock of Do, replaced in tests
+var (
+	now   = time.Now
+	after = time.After
+)
+
+// Policy is how often and for how long a call is retried
+type Policy struct {
+	// Attempts is the number of tries including the first, 1 disables
+	// retries
+	Attempts int
+	// Timeout is the time after the first attempt no retry starts anymore
+	Timeout time.Duration
+}
+
+// IsTransient reports whether err is known to go away when the same call
+// is made again. Cancelled calls never are.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, stateLockError) {
+		return false
+	}
+	for _, transientError := range transientErrors {
+		if strings.Contains(message, transientError) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Do runs fn and retries it with exponential backoff and jitter as long as
+// it fails with errors transient reports as such and policy allows. fn
+// should be a single call that is safe to repeat, like one API request,
+// not an operation made of several.
+func Do(
+	ctx context.Context,
+	policy Policy,
+	operation string,
+	logs log.Logger,
+	transient func(err error) bool,
+	fn func() error,
+) error {
+	start := now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+
+		delay := backoff(attempt)
+		if now().Sub(start)+delay > policy.Timeout {
+			return err
+		}
+
+		logs.Warnf(
+			"%s failed with a transient error, retrying in %s (attempt %d of %d): %v",
+			operation,
+			delay.Round(100*time.Millisecond),
+			attempt+1,
+			policy.Attempts,
+			err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-after(delay):
+		}
+	}
+}
+
+// backoff returns the wait before the retry after attempt. The jitter
+// keeps concurrent operations that failed together from retrying together.
+func backoff(attempt int) time.Duration {
+	delay := MaxDelay
+	if attempt < 16 && BaseDelay<<(attempt-1) < MaxDelay {
+		delay = BaseDelay << (attempt - 1)
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		transient bool
+	}{
+		{err: nil},
+		{err: errors.New("dial tcp 10.0.0.1:8006: connect: connection refused"), transient: true},
+		{err: errors.New("read tcp 10.0.0.2:50312->10.0.0.1:8006: read: connection reset by peer"), transient: true},
+		{err: errors.New("Get \"https://pve:8006/api2/json/version\": net/http: TLS handshake timeout"), transient: true},
+		{err: errors.New("proxmox api GET /cluster/resources: 502 Bad Gateway"), transient: true},
+		{err: errors.New("proxmox api GET /cluster/resources: 503 Service Unavailable"), transient: true},
+		{err: errors.New("proxmox api GET /nodes/pve2/qemu: 596 Connection timed out"), transient: true},
+		{err: fmt.Errorf("terraform apply: %w", errors.New("exit status 1\nError: 503 Service Unavailable")), transient: true},
+		// lock errors may come from steps that changed something already
+		{err: errors.New("proxmox api POST /nodes/pve/qemu/200/config: 500 VM 200 is locked (clone)")},
+		{err: errors.New("task UPID:pve:1:1:1:qmclone:9000:devpod@pve!test: failed: can't lock file '/var/lock/qemu-server/lock-200.conf' - got timeout")},
+		{err: errors.New("terraform apply: exit status 1\nError: error waiting for VM clone: got timeout")},
+		{err: errors.New("terraform apply: exit status 1\nError: Error acquiring the state lock\n\nLock Info: state is locked")},
+		{err: errors.New("terraform apply: exit status 1\nError: Error acquiring the state lock: dial tcp: connection refused")},
+		{err: errors.New("storage 'local-lvm' does not have enough space")},
+		{err: context.Canceled},
+		{err: fmt.Errorf("terraform apply: %w\nconnection reset by peer", context.DeadlineExceeded)},
+	} {
+		if IsTransient(test.err) != test.transient {
+			t.Errorf("expected %v to be transient: %v", test.err, test.transient)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{attempt: 1, delay: 2 * time.Second},
+		{attempt: 2, delay: 4 * time.Second},
+		{attempt: 4, delay: 16 * time.Second},
+		{attempt: 5, delay: 30 * time.Second},
+		{attempt: 16, delay: 30 * time.Second},
+		{attempt: 100, delay: 30 * time.Second},
+	} {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			delay := backoff(test.attempt)
+			if delay < test.delay/2 || delay > test.delay {
+				t.Fatalf("attempt %d: expected a delay between %s and %s, got %s", test.attempt, test.delay/2, test.delay, delay)
+			}
+			seen[delay] = true
+		}
+
+		if len(seen) < 2 {
+			t.Errorf("attempt %d: expected the delays to be jittered, got %v", test.attempt, seen)
+		}
+	}
+}
+
+// fakeClock replaces the clock of Do, advancing on every wait instead of
+// sleeping
+func fakeClock(t *testing.T) *[]time.Duration {
+	current := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	waits := &[]time.Duration{}
+
+	now = func() time.Time {
+		return current
+	}
+	after = func(delay time.Duration) <-chan time.Time {
+		*waits = append(*waits, delay)
+		current = current.Add(delay)
+
+		c := make(chan time.Time, 1)
+		c <- current
+		return c
+	}
+	t.Cleanup(func() {
+		now = time.Now
+		after = time.After
+	})
+
+	return waits
+}
+
+func TestDo(t *testing.T) {
+	transientErr := errors.New("503 Service Unavailable")
+	permanentErr := errors.New("400 Parameter verification failed")
+
+	for _, test := range []struct {
+		name     string
+		policy   Policy
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{
+			name:     "succeeds at once",
+			policy:   Policy{Attempts: 5, Timeout: time.Minute},
+			errs:     []error{nil},
+			attempts: 1,
+		},
+		{
+			name:     "succeeds after transient errors",
+			policy:   Policy{Attempts: 5, Timeout: time.Minute},
+			errs:     []error{transientErr, transientErr, nil},
+			attempts: 3,
+		},
+		{
+			name:     "stops at other errors",
+			policy:   Policy{Attempts: 5, Timeout: time.Minute},
+			errs:     []error{transientErr, permanentErr, nil},
+			attempts: 2,
+			err:      permanentErr,
+		},
+		{
+			name:     "stops after the attempts",
+			policy:   Policy{Attempts: 3, Timeout: time.Hour},
+			errs:     []error{transientErr, transientErr, transientErr, nil},
+			attempts: 3,
+			err:      transientErr,
+		},
+		{
+			name:     "one attempt disables retries",
+			policy:   Policy{Attempts: 1, Timeout: time.Hour},
+			errs:     []error{transientErr, nil},
+			attempts: 1,
+			err:      transientErr,
+		},
+		{
+			// the waits of at least 1s, 2s and 4s add up to more than 6s
+			name:     "stops before the timeout",
+			policy:   Policy{Attempts: 10, Timeout: 6 * time.Second},
+			errs:     []error{transientErr, transientErr, transientErr, transientErr, nil},
+			attempts: 3,
+			err:      transientErr,
+		},
+	} {
+		waits := fakeClock(t)
+
+		attempts := 0
+		err := Do(context.Background(), test.policy, "test", log.Default, IsTransient, func() error {
+			err := test.errs[attempts]
+			attempts++
+			return err
+		})
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+
+		if len(*waits) != attempts-1 {
+			t.Fatalf("%s: expected a wait before each retry, got %v", test.name, *waits)
+		}
+		total := time.Duration(0)
+		for i, wait := range *waits {
+			delay := BaseDelay << i
+			if wait < delay/2 || wait > delay {
+				t.Errorf("%s: expected retry %d to wait between %s and %s, got %s", test.name, i+1, delay/2, delay, wait)
+			}
+			total += wait
+		}
+		if total > test.policy.Timeout {
+			t.Errorf("%s: expected the retries to start within %s, waited %s", test.name, test.policy.Timeout, total)
+		}
+	}
+}
+
+func TestDoCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := Do(ctx, Policy{Attempts: 5, Timeout: time.Hour}, "test", log.Default, IsTransient, func() error {
+		attempts++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return errors.New("connection refused")
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected the cancelled wait to end the retries, got %d attempts, %v", attempts, err)
+	}
+	if time.Since(start) > BaseDelay/2 {
+		t.Fatalf("expected the wait to end on cancel, took %s", time.Since(start))
+	}
+}
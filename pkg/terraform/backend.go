@@ -0,0 +1,185 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+const backendOverrideName = "devpod_backend_override.tf.json"
+
+// isRemoteBackend reports whether the state of the machine is kept
+// outside of the machine folder
+func isRemoteBackend(config *options.Options) bool {
+	return config.TerraformBackend != "" && config.TerraformBackend != options.TERRAFORM_BACKEND_LOCAL
+}
+
+// backendConfig returns the settings of the backend block for the
+// machine. Every machine gets its own state, keyed by its id.
+func backendConfig(config *options.Options) map[string]interface{} {
+	key := config.TerraformBackendPrefix + "/" + config.MachineID
+
+	switch config.TerraformBackend {
+	case options.TERRAFORM_BACKEND_HTTP:
+		address := strings.TrimSuffix(config.TerraformBackendAddress, "/") + "/" + url.PathEscape(key)
+		return map[string]interface{}{
+			"address":        address,
+			"lock_address":   address,
+			"unlock_address": address,
+		}
+	case options.TERRAFORM_BACKEND_S3:
+		settings := map[string]interface{}{
+			"bucket": config.TerraformBackendBucket,
+			"key":    key + ".tfstate",
+			"region": config.TerraformBackendRegion,
+		}
+
+		// s3 compatible stores like MinIO
+		if config.TerraformBackendAddress != "" {
+			settings["endpoint"] = config.TerraformBackendAddress
+			settings["force_path_style"] = true
+			settings["skip_credentials_validation"] = true
+			settings["skip_region_validation"] = true
+			settings["skip_metadata_api_check"] = true
+		}
+
+		return settings
+	case options.TERRAFORM_BACKEND_PG:
+		return map[string]interface{}{
+			"conn_str":    config.TerraformBackendAddress,
+			"schema_name": strings.NewReplacer("-", "_", "/", "_").Replace(key),
+		}
+	case options.TERRAFORM_BACKEND_CONSUL:
+		settings := map[string]interface{}{
+			"address": config.TerraformBackendAddress,
+			"path":    key,
+		}
+		if scheme, address, ok := strings.Cut(config.TerraformBackendAddress, "://"); ok {
+			settings["scheme"] = scheme
+			settings["address"] = address
+		}
+
+		return settings
+	}
+
+	return nil
+}
+
+// backendEnv returns the credentials of the backend in the environment
+// variables the backend reads them from, so they never end up on disk
+func backendEnv(config *options.Options) map[string]string {
+	env := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			env[name] = value
+		}
+	}
+
+	switch config.TerraformBackend {
+	case options.TERRAFORM_BACKEND_HTTP:
+		set("TF_HTTP_USERNAME", config.TerraformBackendUsername)
+		set("TF_HTTP_PASSWORD", config.TerraformBackendPassword)
+	case options.TERRAFORM_BACKEND_S3:
+		set("AWS_ACCESS_KEY_ID", config.TerraformBackendUsername)
+		set("AWS_SECRET_ACCESS_KEY", config.TerraformBackendPassword)
+	case options.TERRAFORM_BACKEND_PG:
+		set("PGUSER", config.TerraformBackendUsername)
+		set("PGPASSWORD", config.TerraformBackendPassword)
+	case options.TERRAFORM_BACKEND_CONSUL:
+		set("CONSUL_HTTP_TOKEN", config.TerraformBackendPassword)
+	}
+
+	return env
+}
+
+// writeBackendOverride configures the backend of the machine through an
+// override file, which takes precedence over a backend the project itself
+// declares. Without a remote backend the file is removed.
+func writeBackendOverride(config *options.Options, workingDir string) error {
+	path := filepath.Join(workingDir, backendOverrideName)
+	if !isRemoteBackend(config) {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	content, err := json.MarshalIndent(map[string]interface{}{
+		"terraform": map[string]interface{}{
+			"backend": map[string]interface{}{
+				config.TerraformBackend: backendConfig(config),
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0644)
+}
+
+// migrateState pushes the local state of a machine created before the
+// remote backend was configured, unless the backend already holds state
+// for it. The local file is kept as main.tfstate.migrated.
+func migrateState(ctx context.Context, providerTerraform *TerraformProvider, tf *tfexec.Terraform) error {
+	if !isRemoteBackend(providerTerraform.Config) {
+		return nil
+	}
+
+	localState := filepath.Join(providerTerraform.Config.MachineFolder, localStateName)
+	_, err := os.Stat(localState)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	remoteState, err := tf.StatePull(ctx)
+	if err != nil {
+		return fmt.Errorf("read state from the %s backend: %w", providerTerraform.Config.TerraformBackend, err)
+	}
+	if strings.TrimSpace(remoteState) != "" {
+		providerTerraform.Log.Warnf(
+			"The %s backend already holds state for this machine, not migrating %s",
+			providerTerraform.Config.TerraformBackend,
+			localState,
+		)
+		return nil
+	}
+
+	err = runChange(ctx, providerTerraform, "state", "push", "-lock=true", "-lock-timeout="+providerTerraform.Config.LockTimeout.String(), localState)
+	if err != nil {
+		return fmt.Errorf("push state to the %s backend: %w", providerTerraform.Config.TerraformBackend, err)
+	}
+
+	providerTerraform.Log.Infof("Migrated the state of the machine to the %s backend", providerTerraform.Config.TerraformBackend)
+	return os.Rename(localState, localState+".migrated")
+}
@@ -0,0 +1,371 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// TestMain lets the test binary stand in for terraform, see fakeTerraform
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_TERRAFORM") == "1" {
+		os.Exit(fakeTerraform(os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeTerraform reports FAKE_TERRAFORM_VERSION as its version and
+// implements the commands migrateState runs against the http backend
+// configured in the override file of the working dir, with the
+// credentials terraform reads from the environment. apply runs until it
+// is interrupted, see fakeApply.
+func fakeTerraform(args []string) int {
+	command := strings.Join(args, " ")
+	if command == "version -json" {
+		fakeVersion := os.Getenv("FAKE_TERRAFORM_VERSION")
+		if fakeVersion == "" {
+			fakeVersion = "1.6.6"
+		}
+
+		fmt.Printf(`{"terraform_version":%q,"platform":"linux_amd64","provider_selections":{},"terraform_outdated":false}`, fakeVersion)
+		return 0
+	}
+	if args[0] == "apply" {
+		return fakeApply()
+	}
+
+	content, err := os.ReadFile(backendOverrideName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	override := struct {
+		Terraform struct {
+			Backend struct {
+				Http struct {
+					Address string `json:"address"`
+				} `json:"http"`
+			} `json:"backend"`
+		} `json:"terraform"`
+	}{}
+	err = json.Unmarshal(content, &override)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var req *http.Request
+	switch {
+	case command == "state pull":
+		req, err = http.NewRequest(http.MethodGet, override.Terraform.Backend.Http.Address, nil)
+	case strings.HasPrefix(command, "state push "):
+		var state *os.File
+		state, err = os.Open(args[len(args)-1])
+		if err != nil {
+			break
+		}
+		defer state.Close()
+
+		req, err = http.NewRequest(http.MethodPost, override.Terraform.Backend.Http.Address, state)
+	default:
+		err = fmt.Errorf("unexpected command %q", command)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	req.SetBasicAuth(os.Getenv("TF_HTTP_USERNAME"), os.Getenv("TF_HTTP_PASSWORD"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		fmt.Fprintln(os.Stderr, resp.Status)
+		return 1
+	}
+
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	return 0
+}
+
+// stateServer is an http state backend keeping the states in memory
+type stateServer struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func (s *stateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != "devpod" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		state, ok := s.states[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		fmt.Fprint(w, state)
+	case http.MethodPost:
+		content, _ := io.ReadAll(r.Body)
+		s.states[r.URL.Path] = string(content)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+// newBackendTest returns a machine using an http backend served by the
+// returned server, with terraform faked by the test binary
+func newBackendTest(t *testing.T) (*TerraformProvider, *tfexec.Terraform, *stateServer) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	t.Setenv("FAKE_TERRAFORM", "1")
+
+	states := &stateServer{states: map[string]string{}}
+	server := httptest.NewServer(states)
+	t.Cleanup(server.Close)
+
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machineFolder := t.TempDir()
+	providerTerraform := &TerraformProvider{
+		Bin:        bin,
+		WorkingDir: filepath.Join(machineFolder, ".terraform"),
+		Config: &options.Options{
+			MachineID:                "devpod-test",
+			MachineFolder:            machineFolder,
+			TerraformBackend:         options.TERRAFORM_BACKEND_HTTP,
+			TerraformBackendAddress:  server.URL + "/state/",
+			TerraformBackendPrefix:   options.DEFAULT_TERRAFORM_BACKEND_PREFIX,
+			TerraformBackendUsername: "devpod",
+			TerraformBackendPassword: "secret",
+		},
+		Log: log.Default,
+	}
+
+	workingDir := providerTerraform.WorkingDir
+	err = os.MkdirAll(workingDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := tfexec.NewTerraform(workingDir, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = setupEnv(providerTerraform, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeBackendOverride(providerTerraform.Config, workingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return providerTerraform, tf, states
+}
+
+func TestMigrateState(t *testing.T) {
+	providerTerraform, tf, states := newBackendTest(t)
+
+	localState := filepath.Join(providerTerraform.Config.MachineFolder, localStateName)
+	state := `{"version":4,"serial":3,"lineage":"a1b2","outputs":{},"resources":[]}`
+	err := os.WriteFile(localState, []byte(state), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateState(context.Background(), providerTerraform, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if states.states["/state/devpod-proxmox/devpod-test"] != state {
+		t.Fatalf("expected the local state to be pushed, got %v", states.states)
+	}
+
+	_, err = os.Stat(localState)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the local state to be moved away, got %v", err)
+	}
+	content, err := os.ReadFile(localState + ".migrated")
+	if err != nil || string(content) != state {
+		t.Errorf("expected the local state to be kept as .migrated, got %q, %v", content, err)
+	}
+
+	// nothing is left to migrate
+	err = migrateState(context.Background(), providerTerraform, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateStateExisting(t *testing.T) {
+	providerTerraform, tf, states := newBackendTest(t)
+	states.states["/state/devpod-proxmox/devpod-test"] = `{"version":4,"serial":7}`
+
+	localState := filepath.Join(providerTerraform.Config.MachineFolder, localStateName)
+	err := os.WriteFile(localState, []byte(`{"version":4,"serial":3}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateState(context.Background(), providerTerraform, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if states.states["/state/devpod-proxmox/devpod-test"] != `{"version":4,"serial":7}` {
+		t.Errorf("expected the state of the backend to be kept, got %v", states.states)
+	}
+	_, err = os.Stat(localState)
+	if err != nil {
+		t.Errorf("expected the local state to be kept, got %v", err)
+	}
+}
+
+func TestMigrateStateCredentials(t *testing.T) {
+	providerTerraform, tf, _ := newBackendTest(t)
+	providerTerraform.Config.TerraformBackendPassword = "wrong"
+	err := setupEnv(providerTerraform, tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localState := filepath.Join(providerTerraform.Config.MachineFolder, localStateName)
+	err = os.WriteFile(localState, []byte(`{"version":4}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateState(context.Background(), providerTerraform, tf)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected the backend to reject the credentials, got %v", err)
+	}
+}
+
+func TestWriteBackendOverride(t *testing.T) {
+	workingDir := t.TempDir()
+	config := &options.Options{
+		MachineID:                "devpod-test",
+		TerraformBackend:         options.TERRAFORM_BACKEND_S3,
+		TerraformBackendAddress:  "https://minio.example.com",
+		TerraformBackendBucket:   "states",
+		TerraformBackendRegion:   options.DEFAULT_TERRAFORM_BACKEND_REGION,
+		TerraformBackendPrefix:   "team",
+		TerraformBackendUsername: "access",
+		TerraformBackendPassword: "secret",
+	}
+
+	err := writeBackendOverride(config, workingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(workingDir, backendOverrideName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "secret") || strings.Contains(string(content), "access") {
+		t.Errorf("expected no credentials in the override file, got %s", content)
+	}
+
+	override := map[string]map[string]map[string]map[string]interface{}{}
+	err = json.Unmarshal(content, &override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := override["terraform"]["backend"]["s3"]
+	if s3["bucket"] != "states" || s3["key"] != "team/devpod-test.tfstate" || s3["endpoint"] != "https://minio.example.com" || s3["force_path_style"] != true {
+		t.Errorf("unexpected s3 settings %v", s3)
+	}
+
+	env := backendEnv(config)
+	expected := map[string]string{"AWS_ACCESS_KEY_ID": "access", "AWS_SECRET_ACCESS_KEY": "secret"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected the credentials %v in the environment, got %v", expected, env)
+	}
+
+	// switching back to local state drops the override
+	config.TerraformBackend = options.TERRAFORM_BACKEND_LOCAL
+	err = writeBackendOverride(config, workingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(workingDir, backendOverrideName))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the override to be removed, got %v", err)
+	}
+}
+
+func TestBackendConfig(t *testing.T) {
+	config := &options.Options{
+		MachineID:               "devpod-test",
+		TerraformBackendPrefix:  "team/dev",
+		TerraformBackendAddress: "https://consul.example.com:8501",
+		TerraformBackend:        options.TERRAFORM_BACKEND_CONSUL,
+	}
+
+	consul := backendConfig(config)
+	if consul["scheme"] != "https" || consul["address"] != "consul.example.com:8501" || consul["path"] != "team/dev/devpod-test" {
+		t.Errorf("unexpected consul settings %v", consul)
+	}
+
+	config.TerraformBackend = options.TERRAFORM_BACKEND_PG
+	config.TerraformBackendAddress = "postgres://db.example.com/states"
+	pg := backendConfig(config)
+	if pg["schema_name"] != "team_dev_devpod_test" {
+		t.Errorf("unexpected pg settings %v", pg)
+	}
+
+	config.TerraformBackend = options.TERRAFORM_BACKEND_HTTP
+	config.TerraformBackendAddress = "https://states.example.com/"
+	httpBackend := backendConfig(config)
+	if httpBackend["address"] != "https://states.example.com/team%2Fdev%2Fdevpod-test" || httpBackend["lock_address"] != httpBackend["address"] {
+		t.Errorf("unexpected http settings %v", httpBackend)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+const (
+	pluginCacheDirName = "plugin-cache"
+	cliConfigName      = "devpod.tfrc"
+)
+
+// PluginCacheLockTimeout is how long to wait for another machine to finish
+// installing providers into the shared plugin cache
+var PluginCacheLockTimeout = 10 * time.Minute
+
+// setupEnv points terraform at the plugin cache shared by all machines of
+// this host and, with TERRAFORM_PROVIDER_MIRROR, at a CLI config that
+// installs providers from the mirror only. It also passes the credentials
+// of a remote backend.
+func setupEnv(providerTerraform *TerraformProvider, tf *tfexec.Terraform) error {
+	env, err := terraformEnv(providerTerraform)
+	if err != nil {
+		return err
+	}
+
+	return tf.SetEnv(env)
+}
+
+// terraformEnv returns the environment setupEnv gives terraform
+func terraformEnv(providerTerraform *TerraformProvider) (map[string]string, error) {
+	env := map[string]string{}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		env[key] = value
+	}
+	for _, key := range tfexec.ProhibitedEnv(env) {
+		delete(env, key)
+	}
+
+	// keep a cache the user configured themselves
+	if env["TF_PLUGIN_CACHE_DIR"] == "" {
+		cacheDir, err := pluginCacheDir()
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(cacheDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		env["TF_PLUGIN_CACHE_DIR"] = cacheDir
+	}
+
+	for key, value := range backendEnv(providerTerraform.Config) {
+		env[key] = value
+	}
+
+	mirror := providerTerraform.Config.TerraformProviderMirror
+	if mirror != "" {
+		content, err := cliConfig(mirror)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(providerTerraform.Config.MachineFolder, cliConfigName)
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		env["TF_CLI_CONFIG_FILE"] = path
+	}
+
+	return env, nil
+}
+
+func pluginCacheDir() (string, error) {
+	dir, err := registry.GetDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, pluginCacheDirName), nil
+}
+
+// lockPluginCache serializes terraform init across machines, the plugin
+// cache is not safe for concurrent installs
+func lockPluginCache(ctx context.Context) (*lock.Lock, error) {
+	cacheDir, err := pluginCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Acquire(ctx, cacheDir+".lock", "terraform init", PluginCacheLockTimeout)
+}
+
+// cliConfig returns a terraform CLI config that installs all providers
+// from mirror, a https url for a network mirror or a directory for a
+// filesystem mirror
+func cliConfig(mirror string) (string, error) {
+	if strings.HasPrefix(mirror, "https://") {
+		if !strings.HasSuffix(mirror, "/") {
+			mirror += "/"
+		}
+
+		return fmt.Sprintf("provider_installation {\n  network_mirror {\n    url = %q\n  }\n}\n", mirror), nil
+	}
+
+	path, err := filepath.Abs(mirror)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("terraform provider mirror: %w", err)
+	}
+
+	return fmt.Sprintf("provider_installation {\n  filesystem_mirror {\n    path = %q\n  }\n}\n", filepath.ToSlash(path)), nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/examples"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+// EmbeddedSource is the source recorded for machines using the project
+// built into the binary
+const EmbeddedSource = "embedded"
+
+var (
+	embeddedVersion     string
+	embeddedVersionOnce sync.Once
+)
+
+// EmbeddedVersion stamps the project built into the binary, it changes
+// whenever a file of the project does
+func EmbeddedVersion() string {
+	embeddedVersionOnce.Do(func() {
+		hash := sha256.New()
+		_ = fs.WalkDir(examples.Proxmox, examples.ProxmoxDir, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+
+			content, err := examples.Proxmox.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			_, _ = io.WriteString(hash, name+"\x00")
+			_, _ = hash.Write(content)
+			return nil
+		})
+
+		embeddedVersion = hex.EncodeToString(hash.Sum(nil))[:12]
+	})
+
+	return embeddedVersion
+}
+
+// writeEmbeddedProject materializes the project built into the binary at
+// dest and records its version
+func writeEmbeddedProject(providerTerraform *TerraformProvider, dest string) error {
+	err := fs.WalkDir(examples.Proxmox, examples.ProxmoxDir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(examples.ProxmoxDir, filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		content, err := examples.Proxmox.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(target, content, 0644)
+	})
+	if err != nil {
+		return err
+	}
+
+	providerTerraform.Log.Infof("Using the built-in terraform project, version %s", EmbeddedVersion())
+	return registry.WriteJSON(filepath.Join(providerTerraform.Config.MachineFolder, projectRecordFile), &ProjectRecord{
+		Source:  EmbeddedSource,
+		Commit:  EmbeddedVersion(),
+		Updated: time.Now(),
+	})
+}
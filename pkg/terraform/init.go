@@ -0,0 +1,138 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+const (
+	lockFileName  = ".terraform.lock.hcl"
+	dataDirName   = ".terraform"
+	initStampName = "devpod-init.json"
+)
+
+// initStamp records the project hash a working directory was initialized for
+type initStamp struct {
+	Hash     string    `json:"hash"`
+	Modified time.Time `json:"modified"`
+}
+
+// projectHash hashes everything terraform init depends on: the
+// configuration files of the project and the dependency lock file
+func projectHash(workingDir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(workingDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := entry.Name()
+		if entry.IsDir() {
+			if path != workingDir && (name == dataDirName || name == ".git") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !strings.HasSuffix(name, ".tf") &&
+			!strings.HasSuffix(name, ".tf.json") &&
+			name != lockFileName {
+			return nil
+		}
+
+		rel, err := filepath.Rel(workingDir, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, _ = io.WriteString(hash, filepath.ToSlash(rel)+"\x00")
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isInitialized reports whether the working directory has a lock file and
+// installed providers that match the current project
+func isInitialized(workingDir string) (bool, error) {
+	for _, path := range []string{
+		filepath.Join(workingDir, lockFileName),
+		filepath.Join(workingDir, dataDirName, "providers"),
+	} {
+		_, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return false, nil
+			}
+
+			return false, err
+		}
+	}
+
+	stamp := &initStamp{}
+	err := registry.ReadJSON(filepath.Join(workingDir, dataDirName, initStampName), stamp)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	hash, err := projectHash(workingDir)
+	if err != nil {
+		return false, err
+	}
+
+	return stamp.Hash == hash, nil
+}
+
+// writeInitStamp records that the working directory is initialized for
+// the current project
+func writeInitStamp(workingDir string) error {
+	hash, err := projectHash(workingDir)
+	if err != nil {
+		return err
+	}
+
+	return registry.WriteJSON(filepath.Join(workingDir, dataDirName, initStampName), &initStamp{
+		Hash:     hash,
+		Modified: time.Now(),
+	})
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hc-install/product"
+	"github.com/hashicorp/hc-install/releases"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/loft-sh/devpod/pkg/config"
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// MinimumVersions are the oldest versions of each engine the provider
+// works with
+var MinimumVersions = map[string]*version.Version{
+	options.TERRAFORM_ENGINE_TERRAFORM: version.Must(version.NewVersion("1.4.0")),
+	options.TERRAFORM_ENGINE_TOFU:      version.Must(version.NewVersion("1.6.0")),
+}
+
+// DownloadTimeout is how long downloading a release may take, and how
+// long to wait for another machine installing the same release
+var DownloadTimeout = 10 * time.Minute
+
+// downloadClient fetches releases through the proxy configured in the
+// environment, e.g. HTTPS_PROXY, verifying them against the system
+// certificates
+var downloadClient = &http.Client{Transport: downloadTransport()}
+
+func downloadTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return transport
+}
+
+const tofuReleasesUrl = "https://github.com/opentofu/opentofu/releases/download"
+
+// Binary is the terraform or OpenTofu binary applying the project
+type Binary struct {
+	Engine  string
+	Version string
+	Path    string
+
+	// External binaries are given by the user and never installed
+	External bool
+
+	// Archive is a local release zip to install from instead of
+	// downloading, verified against ArchiveSha256
+	Archive       string
+	ArchiveSha256 string
+}
+
+// BinaryFromEnv reads which binary to use from the environment. Installed
+// binaries live in a directory per engine and version under the DevPod
+// config dir, so changing the version never swaps the binary of running
+// machines in place.
+func BinaryFromEnv() (*Binary, error) {
+	engine, err := options.GetTerraformEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultVersion := options.DEFAULT_TERRAFORM_VERSION
+	if engine == options.TERRAFORM_ENGINE_TOFU {
+		defaultVersion = options.DEFAULT_TOFU_VERSION
+	}
+
+	binary := &Binary{
+		Engine:        engine,
+		Version:       strings.TrimPrefix(options.FromEnvOrDefault(options.TERRAFORM_VERSION, defaultVersion), "v"),
+		Archive:       os.Getenv(options.TERRAFORM_ARCHIVE),
+		ArchiveSha256: os.Getenv(options.TERRAFORM_ARCHIVE_SHA256),
+	}
+
+	_, err = version.NewVersion(binary.Version)
+	if err != nil {
+		return nil, fmt.Errorf("option %s: %w", options.TERRAFORM_VERSION, err)
+	}
+
+	if binary.Archive != "" && binary.ArchiveSha256 == "" {
+		return nil, fmt.Errorf("option %s is required with %s", options.TERRAFORM_ARCHIVE_SHA256, options.TERRAFORM_ARCHIVE)
+	}
+
+	bin := os.Getenv(options.TERRAFORM_BIN)
+	if bin != "" {
+		binary.Path = bin
+		binary.External = true
+		return binary, nil
+	}
+
+	devpodPath, err := config.GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	binary.Path = filepath.Join(devpodPath, "bin", engine+"-"+binary.Version, executableName(engine))
+	return binary, nil
+}
+
+func executableName(engine string) string {
+	if runtime.GOOS == "windows" {
+		return engine + ".exe"
+	}
+
+	return engine
+}
+
+// Install makes sure the binary is in place, installing it unless it was
+// given by the user, and refuses versions older than the supported minimum
+func Install(ctx context.Context, providerTerraform *TerraformProvider) error {
+	binary := providerTerraform.Binary
+
+	if !binary.External {
+		err := ensureInstalled(ctx, binary, providerTerraform.Log)
+		if err != nil {
+			return err
+		}
+	}
+
+	binaryVersion, err := getVersion(ctx, binary.Path)
+	if err != nil {
+		return fmt.Errorf("get version of %s: %w", binary.Path, err)
+	}
+
+	minimum := MinimumVersions[binary.Engine]
+	if binaryVersion.LessThan(minimum) {
+		return fmt.Errorf(
+			"%s %s is not supported, the provider needs at least %s",
+			binary.Engine,
+			binaryVersion,
+			minimum,
+		)
+	}
+
+	if binary.External && os.Getenv(options.TERRAFORM_VERSION) != "" &&
+		!binaryVersion.Equal(version.Must(version.NewVersion(binary.Version))) {
+		providerTerraform.Log.Warnf(
+			"%s is version %s, not %s as set in %s",
+			binary.Path,
+			binaryVersion,
+			binary.Version,
+			options.TERRAFORM_VERSION,
+		)
+	}
+
+	providerTerraform.Log.Infof("Using %s %s from %s", binary.Engine, binaryVersion, binary.Path)
+	return nil
+}
+
+func getVersion(ctx context.Context, bin string) (*version.Version, error) {
+	tf, err := tfexec.NewTerraform(filepath.Dir(bin), bin)
+	if err != nil {
+		return nil, err
+	}
+
+	binaryVersion, _, err := tf.Version(ctx, true)
+	return binaryVersion, err
+}
+
+// ensureInstalled installs the binary unless it is in place. Installs of
+// a release are serialized across processes, so concurrent creates
+// neither download it twice nor write over each other.
+func ensureInstalled(ctx context.Context, binary *Binary, logs log.Logger) error {
+	_, err := os.Stat(binary.Path)
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	destPath := filepath.Dir(binary.Path)
+	installLock, err := lock.Acquire(ctx, destPath+".lock", "install of "+binary.Engine+" "+binary.Version, DownloadTimeout)
+	if err != nil {
+		return err
+	}
+	defer installLock.Release()
+
+	// another process may have installed it while we waited
+	_, err = os.Stat(binary.Path)
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return install(ctx, binary, logs)
+}
+
+func install(ctx context.Context, binary *Binary, logs log.Logger) error {
+	destPath := filepath.Dir(binary.Path)
+	err := os.MkdirAll(destPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if binary.Archive != "" {
+		logs.Infof("Installing %s from %s", binary.Engine, binary.Archive)
+		return extractArchive(binary.Archive, binary.ArchiveSha256, binary.Path)
+	}
+
+	logs.Infof("Downloading %s %s", binary.Engine, binary.Version)
+
+	ctx, cancel := context.WithTimeout(ctx, DownloadTimeout)
+	defer cancel()
+
+	if binary.Engine == options.TERRAFORM_ENGINE_TOFU {
+		return installTofu(ctx, binary)
+	}
+
+	installer := &releases.ExactVersion{
+		InstallDir: destPath,
+		Product:    product.Terraform,
+		Version:    version.Must(version.NewVersion(binary.Version)),
+	}
+
+	_, err = installer.Install(ctx)
+	return err
+}
+
+// installTofu downloads an OpenTofu release from GitHub and verifies it
+// against the checksums published with it
+func installTofu(ctx context.Context, binary *Binary) error {
+	archiveName := fmt.Sprintf("tofu_%s_%s_%s.zip", binary.Version, runtime.GOOS, runtime.GOARCH)
+	releaseUrl := tofuReleasesUrl + "/v" + binary.Version
+
+	checksums := &strings.Builder{}
+	err := download(ctx, releaseUrl+"/tofu_"+binary.Version+"_SHA256SUMS", checksums)
+	if err != nil {
+		return err
+	}
+
+	checksum := ""
+	scanner := bufio.NewScanner(strings.NewReader(checksums.String()))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == archiveName {
+			checksum = fields[0]
+		}
+	}
+	if checksum == "" {
+		return fmt.Errorf("no checksum published for %s", archiveName)
+	}
+
+	archive, err := os.CreateTemp("", "tofu-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+
+	err = download(ctx, releaseUrl+"/"+archiveName, archive)
+	closeErr := archive.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return extractArchive(archive.Name(), checksum, binary.Path)
+}
+
+func download(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// extractArchive verifies the release zip at archive against checksum and
+// extracts the binary of the same name as dest to dest
+func extractArchive(archive string, checksum string, dest string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, strings.TrimSpace(checksum)) {
+		return fmt.Errorf("checksum of %s is %s, expected %s", archive, actual, checksum)
+	}
+
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	name := filepath.Base(dest)
+	for _, entry := range reader.File {
+		if entry.Name != name {
+			continue
+		}
+
+		src, err := entry.Open()
+		if err != nil {
+			return err
+		}
+
+		tmp := dest + ".tmp"
+		out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			_ = src.Close()
+			return err
+		}
+
+		_, err = io.Copy(out, src)
+		_ = src.Close()
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+
+		return os.Rename(tmp, dest)
+	}
+
+	return fmt.Errorf("%s doesn't contain %s", archive, name)
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// writeArchive writes a release zip with the given entries and returns
+// its path and checksum
+func writeArchive(t *testing.T, entries map[string][]byte) (string, string) {
+	path := filepath.Join(t.TempDir(), "release.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := zip.NewWriter(file)
+	for name, content := range entries {
+		entry, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = entry.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(content)
+
+	return path, hex.EncodeToString(hash[:])
+}
+
+func TestExtractArchive(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		entries  map[string]string
+		checksum func(checksum string) string
+		expected string
+	}{
+		{
+			name:     "picks the binary",
+			entries:  map[string]string{"LICENSE": "license", "terraform": "binary", "README.md": "readme"},
+			expected: "binary",
+		},
+		{
+			name:     "accepts checksums in upper case",
+			entries:  map[string]string{"terraform": "binary"},
+			checksum: func(checksum string) string { return " " + strings.ToUpper(checksum) + "\n" },
+			expected: "binary",
+		},
+		{
+			name:    "ignores other paths of the same name",
+			entries: map[string]string{"bin/terraform": "nested", "terraform.exe": "windows"},
+		},
+		{
+			name:     "refuses a wrong checksum",
+			entries:  map[string]string{"terraform": "binary"},
+			checksum: func(string) string { return strings.Repeat("0", 64) },
+		},
+		{
+			name:     "refuses a missing checksum",
+			entries:  map[string]string{"terraform": "binary"},
+			checksum: func(string) string { return "" },
+		},
+	} {
+		entries := map[string][]byte{}
+		for name, content := range test.entries {
+			entries[name] = []byte(content)
+		}
+		archive, checksum := writeArchive(t, entries)
+		if test.checksum != nil {
+			checksum = test.checksum(checksum)
+		}
+
+		dest := filepath.Join(t.TempDir(), "terraform")
+		err := extractArchive(archive, checksum, dest)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			if _, statErr := os.Stat(dest); !os.IsNotExist(statErr) {
+				t.Errorf("%s: expected nothing to be extracted, got %v", test.name, statErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		content, err := os.ReadFile(dest)
+		if err != nil || string(content) != test.expected {
+			t.Errorf("%s: expected %q, got %q, %v", test.name, test.expected, content, err)
+		}
+		if _, err := os.Stat(dest + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the temporary file to be gone, got %v", test.name, err)
+		}
+	}
+}
+
+func TestInstallMinimumVersion(t *testing.T) {
+	t.Setenv("FAKE_TERRAFORM", "1")
+	t.Setenv(options.TERRAFORM_VERSION, "")
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		engine  string
+		version string
+		fails   bool
+	}{
+		{engine: options.TERRAFORM_ENGINE_TERRAFORM, version: "1.6.6"},
+		{engine: options.TERRAFORM_ENGINE_TERRAFORM, version: "1.4.0"},
+		{engine: options.TERRAFORM_ENGINE_TERRAFORM, version: "1.3.9", fails: true},
+		{engine: options.TERRAFORM_ENGINE_TERRAFORM, version: "0.15.5", fails: true},
+		{engine: options.TERRAFORM_ENGINE_TOFU, version: "1.6.0"},
+		{engine: options.TERRAFORM_ENGINE_TOFU, version: "1.5.7", fails: true},
+	} {
+		t.Setenv("FAKE_TERRAFORM_VERSION", test.version)
+
+		err := Install(context.Background(), &TerraformProvider{
+			Binary: &Binary{Engine: test.engine, Version: test.version, Path: executable, External: true},
+			Log:    log.Default,
+		})
+		if test.fails && err == nil {
+			t.Errorf("%s %s: expected to be refused", test.engine, test.version)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s %s: %v", test.engine, test.version, err)
+		}
+	}
+}
+
+// TestInstallArchive installs the test binary, which fakes terraform, from
+// a release zip by several machines at once
+func TestInstallArchive(t *testing.T) {
+	t.Setenv("FAKE_TERRAFORM", "1")
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := executableName(options.TERRAFORM_ENGINE_TERRAFORM)
+	archive, checksum := writeArchive(t, map[string][]byte{name: content, "LICENSE": []byte("license")})
+	binary := &Binary{
+		Engine:        options.TERRAFORM_ENGINE_TERRAFORM,
+		Version:       "1.6.6",
+		Path:          filepath.Join(t.TempDir(), "bin", "terraform-1.6.6", name),
+		Archive:       archive,
+		ArchiveSha256: checksum,
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Install(context.Background(), &TerraformProvider{Binary: binary, Log: log.Default})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(binary.Path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the binary to be installed, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+
+	cp "github.com/otiai10/copy"
+)
+
+const projectRecordFile = "project.json"
+
+// ProjectSource is a TERRAFORM_PROJECT pointing to a git repository, in
+// the notation of terraform module sources:
+// https://host/repo.git//examples/proxmox?ref=v1.2.0
+type ProjectSource struct {
+	Repo   string
+	Subdir string
+	Ref    string
+}
+
+// ProjectRecord is the project a machine uses, a git checkout or the
+// project built into the binary. Commit is the version of the latter.
+type ProjectRecord struct {
+	Source  string    `json:"source"`
+	Commit  string    `json:"commit"`
+	Updated time.Time `json:"updated"`
+}
+
+// ParseProjectSource parses project if it is a git source, http(s), ssh
+// and scp-like git@ urls are understood
+func ParseProjectSource(project string) (*ProjectSource, bool, error) {
+	raw := strings.TrimPrefix(project, "git::")
+	if !strings.HasPrefix(raw, "http://") &&
+		!strings.HasPrefix(raw, "https://") &&
+		!strings.HasPrefix(raw, "ssh://") &&
+		!strings.HasPrefix(raw, "git@") {
+		return nil, false, nil
+	}
+
+	source := &ProjectSource{}
+	if base, query, ok := strings.Cut(raw, "?"); ok {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, false, fmt.Errorf("parse terraform project %s: %w", project, err)
+		}
+
+		source.Ref = values.Get("ref")
+		raw = base
+	}
+
+	// the subdirectory follows a double slash after the host
+	start := 0
+	if i := strings.Index(raw, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	if i := strings.Index(raw[start:], "//"); i >= 0 {
+		source.Subdir = strings.Trim(raw[start+i+2:], "/")
+		raw = raw[:start+i]
+	}
+
+	if source.Subdir != "" && !filepath.IsLocal(source.Subdir) {
+		return nil, false, fmt.Errorf("subdirectory %s of terraform project %s leaves the repository", source.Subdir, project)
+	}
+
+	source.Repo = raw
+	return source, true, nil
+}
+
+// checkoutProject fetches the ref of source without history and copies
+// its subdirectory to dest, then records the resolved commit
+func checkoutProject(ctx context.Context, providerTerraform *TerraformProvider, source *ProjectSource, dest string) error {
+	return fetchProject(ctx, source, func(dir string, commit string) error {
+		return copyProject(providerTerraform, filepath.Join(dir, source.Subdir), commit, dest)
+	})
+}
+
+// fetchProject checks out the ref of source without history into a
+// temporary directory and passes it to use together with the commit
+func fetchProject(ctx context.Context, source *ProjectSource, use func(dir string, commit string) error) error {
+	tmpDir, err := os.MkdirTemp("", "devpod-proxmox-project-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	_, err = git(ctx, tmpDir, "init", "-q")
+	if err != nil {
+		return err
+	}
+
+	_, err = git(ctx, tmpDir, "fetch", "-q", "--depth", "1", source.Repo, ref)
+	if err != nil {
+		return err
+	}
+
+	_, err = git(ctx, tmpDir, "-c", "advice.detachedHead=false", "checkout", "-q", "FETCH_HEAD")
+	if err != nil {
+		return err
+	}
+
+	commit, err := git(ctx, tmpDir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	return use(tmpDir, commit)
+}
+
+func copyProject(providerTerraform *TerraformProvider, src string, commit string, dest string) error {
+	_, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("terraform project %s: %w", providerTerraform.Project, err)
+	}
+
+	err = cp.Copy(src, dest, cp.Options{
+		Skip: func(path string) (bool, error) {
+			return filepath.Base(path) == ".git", nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	providerTerraform.Log.Infof("Checked out terraform project %s at %s", providerTerraform.Project, commit)
+	return registry.WriteJSON(filepath.Join(providerTerraform.Config.MachineFolder, projectRecordFile), &ProjectRecord{
+		Source:  providerTerraform.Project,
+		Commit:  commit,
+		Updated: time.Now(),
+	})
+}
+
+// updateProject moves the machine to the configured project if it
+// changed and TERRAFORM_PROJECT_UPDATE is set, or always with force. This
+// covers git sources, including branches that moved since the checkout,
+// and the project built into the binary. The files of the project are
+// replaced under the machine lock, terraform's data and lock file kept
+// unless the new project brings its own.
+func updateProject(ctx context.Context, providerTerraform *TerraformProvider, force bool) error {
+	var source *ProjectSource
+	wanted := EmbeddedSource + " " + EmbeddedVersion()
+	if providerTerraform.Project != "" {
+		var ok bool
+		var err error
+		source, ok, err = ParseProjectSource(providerTerraform.Project)
+		if err != nil || !ok {
+			return err
+		}
+
+		wanted = providerTerraform.Project
+	}
+
+	record, err := LoadProjectRecord(providerTerraform.Config.MachineFolder)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		if record != nil && record.Source == projectSource(providerTerraform) {
+			if source == nil && record.Commit == EmbeddedVersion() {
+				return nil
+			}
+
+			// only look for new commits when they would be checked out
+			if source != nil && !providerTerraform.Config.TerraformProjectUpdate {
+				return nil
+			}
+
+			if source != nil {
+				commit, err := remoteCommit(ctx, source)
+				if err != nil {
+					providerTerraform.Log.Warnf("Couldn't check terraform project %s for updates: %v", record.Source, err)
+					return nil
+				}
+				if commit != "" && strings.HasPrefix(record.Commit, commit) {
+					return nil
+				}
+
+				wanted = providerTerraform.Project + " at " + commit
+			}
+		}
+
+		if !providerTerraform.Config.TerraformProjectUpdate {
+			if record != nil {
+				providerTerraform.Log.Warnf(
+					"Machine uses terraform project %s at %s, set %s to move it to %s",
+					record.Source,
+					record.Commit,
+					options.TERRAFORM_PROJECT_UPDATE,
+					wanted,
+				)
+			}
+
+			return nil
+		}
+	}
+
+	// commands and status don't hold the machine lock, operations
+	// changing the machine must not see the project half replaced
+	lockPath := filepath.Join(providerTerraform.Config.MachineFolder, lock.MachineFile)
+	if !lock.Held(ctx, lockPath) {
+		machineLock, err := lock.Acquire(ctx, lockPath, "project update", providerTerraform.Config.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer machineLock.Release()
+	}
+
+	workingDir := providerTerraform.Config.MachineFolder + "/.terraform"
+	if source == nil {
+		err = clearProject(workingDir)
+		if err != nil {
+			return err
+		}
+
+		return writeEmbeddedProject(providerTerraform, workingDir)
+	}
+
+	return fetchProject(ctx, source, func(dir string, commit string) error {
+		src := filepath.Join(dir, source.Subdir)
+		_, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("terraform project %s: %w", providerTerraform.Project, err)
+		}
+
+		err = clearProject(workingDir)
+		if err != nil {
+			return err
+		}
+
+		return copyProject(providerTerraform, src, commit, workingDir)
+	})
+}
+
+// remoteCommit asks the repository of source which commit its ref points
+// to, the way git fetch resolves it. Tags resolve to the commit they tag.
+// Refs that aren't advertised, like commit ids, are returned as they are.
+func remoteCommit(ctx context.Context, source *ProjectSource) (string, error) {
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	out, err := git(ctx, "", "ls-remote", source.Repo)
+	if err != nil {
+		return "", err
+	}
+
+	return resolveRef(out, ref), nil
+}
+
+// resolveRef looks ref up in the output of git ls-remote, preferring
+// full names over tags over branches
+func resolveRef(lsRemote string, ref string) string {
+	commits := map[string]string{}
+	for _, line := range strings.Split(lsRemote, "\n") {
+		commit, name, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if ok {
+			commits[name] = commit
+		}
+	}
+
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		// annotated tags are followed by the commit they point to
+		if commit, ok := commits[name+"^{}"]; ok {
+			return commit
+		}
+		if commit, ok := commits[name]; ok {
+			return commit
+		}
+	}
+
+	return ref
+}
+
+func projectSource(providerTerraform *TerraformProvider) string {
+	if providerTerraform.Project == "" {
+		return EmbeddedSource
+	}
+
+	return providerTerraform.Project
+}
+
+// clearProject removes the files of the project from the working dir,
+// keeping terraform's data and lock file
+func clearProject(workingDir string) error {
+	entries, err := os.ReadDir(workingDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == dataDirName || entry.Name() == lockFileName {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(workingDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadProjectRecord returns the checkout the machine uses, or nil if its
+// project is not a git source or predates recording it
+func LoadProjectRecord(machineFolder string) (*ProjectRecord, error) {
+	record := &ProjectRecord{}
+	err := registry.ReadJSON(filepath.Join(machineFolder, projectRecordFile), record)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// fail instead of waiting for credentials nobody can enter
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
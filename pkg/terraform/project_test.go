@@ -0,0 +1,149 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/lock"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/registry"
+)
+
+func TestResolveRef(t *testing.T) {
+	lsRemote := "1111\tHEAD\n" +
+		"2222\trefs/heads/main\n" +
+		"3333\trefs/heads/v1\n" +
+		"4444\trefs/tags/v1\n" +
+		"5555\trefs/tags/v1^{}\n" +
+		"6666\trefs/tags/light\n"
+
+	for _, test := range []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "HEAD", expected: "1111"},
+		{ref: "main", expected: "2222"},
+		{ref: "refs/heads/main", expected: "2222"},
+		{ref: "heads/v1", expected: "3333"},
+		{ref: "v1", expected: "5555"},
+		{ref: "light", expected: "6666"},
+		{ref: "0123abc", expected: "0123abc"},
+	} {
+		commit := resolveRef(lsRemote, test.ref)
+		if commit != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.ref, test.expected, commit)
+		}
+	}
+}
+
+// TestRemoteCommit follows a branch moving in a local repository
+func TestRemoteCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	ctx := context.Background()
+	repo := t.TempDir()
+	run := func(args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		out, err := git(ctx, repo, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return out
+	}
+
+	run("init", "-q", "-b", "main")
+	run("commit", "-q", "--allow-empty", "-m", "first")
+	run("tag", "-a", "-m", "release", "v1")
+	first := run("rev-parse", "HEAD")
+	run("commit", "-q", "--allow-empty", "-m", "second")
+	second := run("rev-parse", "HEAD")
+
+	for _, test := range []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "", expected: second},
+		{ref: "main", expected: second},
+		{ref: "v1", expected: first},
+		{ref: first, expected: first},
+	} {
+		commit, err := remoteCommit(ctx, &ProjectSource{Repo: repo, Ref: test.ref})
+		if err != nil || commit != test.expected {
+			t.Errorf("%q: expected %s, got %s, %v", test.ref, test.expected, commit, err)
+		}
+	}
+}
+
+// TestUpdateProjectLock moves a machine to the embedded project, which
+// only happens under the machine lock
+func TestUpdateProjectLock(t *testing.T) {
+	ctx := context.Background()
+	machineFolder := t.TempDir()
+	workingDir := filepath.Join(machineFolder, ".terraform")
+	err := os.MkdirAll(workingDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.WriteJSON(filepath.Join(machineFolder, projectRecordFile), &ProjectRecord{
+		Source:  EmbeddedSource,
+		Commit:  "outdated",
+		Updated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerTerraform := &TerraformProvider{
+		Config: &options.Options{MachineFolder: machineFolder, TerraformProjectUpdate: true},
+		Log:    log.Default,
+	}
+
+	lockPath := filepath.Join(machineFolder, lock.MachineFile)
+	held, err := lock.Acquire(ctx, lockPath, "create", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	// another operation holds the lock
+	err = updateProject(ctx, providerTerraform, false)
+	heldErr := &lock.HeldError{}
+	if !errors.As(err, &heldErr) {
+		t.Fatalf("expected the update to wait for the lock, got %v", err)
+	}
+
+	// the operation holding the lock updates
+	err = updateProject(lock.NewContext(ctx, held), providerTerraform, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := LoadProjectRecord(machineFolder)
+	if err != nil || record == nil || record.Commit != EmbeddedVersion() {
+		t.Fatalf("expected the embedded project to be recorded, got %+v, %v", record, err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
+)
+
+// ShutdownGrace is how long terraform may take to stop after the operation
+// was interrupted, before it is killed
+var ShutdownGrace = time.Minute
+
+// runChange runs a terraform command changing the state, like apply. tfexec
+// kills terraform as soon as the context is done, which leaves resources
+// it was creating behind and the state locked. Instead terraform is
+// interrupted once, so it stops its operations and saves the state, and
+// only killed if it is still running ShutdownGrace later. It runs in a
+// process group of its own, as a second interrupt from the terminal would
+// make it abort right away. Runs that couldn't reach Proxmox are repeated,
+// terraform picks up from the state the failed run saved.
+func runChange(ctx context.Context, providerTerraform *TerraformProvider, args ...string) error {
+	policy := retry.Policy{
+		Attempts: providerTerraform.Config.RetryAttempts,
+		Timeout:  providerTerraform.Config.RetryTimeout,
+	}
+
+	return retry.Do(ctx, policy, "terraform "+args[0], providerTerraform.Log, retry.IsTransient, func() error {
+		return run(ctx, providerTerraform, args...)
+	})
+}
+
+func run(ctx context.Context, providerTerraform *TerraformProvider, args ...string) error {
+	env, err := terraformEnv(providerTerraform)
+	if err != nil {
+		return err
+	}
+	env["TF_IN_AUTOMATION"] = "1"
+
+	cmd := exec.CommandContext(ctx, providerTerraform.Bin, args...)
+	cmd.Dir = providerTerraform.WorkingDir
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.SysProcAttr = sysProcAttr()
+	cmd.Cancel = func() error {
+		providerTerraform.Log.Warnf("Interrupted, waiting up to %s for terraform to stop and save its state", ShutdownGrace)
+		return interrupt(cmd.Process)
+	}
+	cmd.WaitDelay = ShutdownGrace
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return fmt.Errorf("terraform %s: %w\n%s", args[0], err, strings.TrimSpace(stderr.String()))
+}
+
+// stateArgs are the options of the commands applying the project to the
+// state of the machine
+func stateArgs(providerTerraform *TerraformProvider, varFile string) []string {
+	args := []string{
+		"-no-color",
+		"-input=false",
+		"-lock=true",
+		"-lock-timeout=" + providerTerraform.Config.LockTimeout.String(),
+	}
+	if providerTerraform.State != "" {
+		args = append(args, "-state="+providerTerraform.State)
+	}
+
+	return append(args, "-var-file="+varFile)
+}
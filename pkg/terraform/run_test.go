@@ -0,0 +1,173 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
+)
+
+// fakeApply marks the working dir as started and waits to be interrupted,
+// marking it as interrupted then. With FAKE_TERRAFORM_IGNORE_INTERRUPT it
+// goes on until it is killed. With FAKE_TERRAFORM_ERROR it counts its runs
+// in the working dir instead and fails with the error for the first
+// FAKE_TERRAFORM_FAILURES of them.
+func fakeApply() int {
+	if message := os.Getenv("FAKE_TERRAFORM_ERROR"); message != "" {
+		runs, _ := os.ReadFile("runs")
+		count := len(runs) + 1
+		_ = os.WriteFile("runs", append(runs, '.'), 0644)
+
+		failures, _ := strconv.Atoi(os.Getenv("FAKE_TERRAFORM_FAILURES"))
+		if count <= failures {
+			fmt.Fprintln(os.Stderr, message)
+			return 1
+		}
+		return 0
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	_ = os.WriteFile("started", nil, 0644)
+	<-interrupts
+	if os.Getenv("FAKE_TERRAFORM_IGNORE_INTERRUPT") == "1" {
+		time.Sleep(time.Minute)
+	}
+
+	_ = os.WriteFile("interrupted", nil, 0644)
+	return 1
+}
+
+// interruptApply runs apply with the fake terraform, cancels it once it
+// runs and returns the error and how long it took to stop
+func interruptApply(t *testing.T, providerTerraform *TerraformProvider) (error, time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cancelled := make(chan time.Time, 1)
+	go func() {
+		for ctx.Err() == nil {
+			_, err := os.Stat(filepath.Join(providerTerraform.WorkingDir, "started"))
+			if err == nil {
+				cancelled <- time.Now()
+				cancel()
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	err := runChange(ctx, providerTerraform, "apply")
+	select {
+	case at := <-cancelled:
+		return err, time.Since(at)
+	default:
+		t.Fatalf("expected apply to run until interrupted, got %v", err)
+		return nil, 0
+	}
+}
+
+func TestRunChangeInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("terraform is killed right away on windows")
+	}
+	providerTerraform, _, _ := newBackendTest(t)
+	providerTerraform.Config.RetryAttempts = 3
+	providerTerraform.Config.RetryTimeout = time.Minute
+
+	err, _ := interruptApply(t, providerTerraform)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the apply to be cancelled, got %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(providerTerraform.WorkingDir, "interrupted"))
+	if err != nil {
+		t.Fatalf("expected terraform to be interrupted and stop by itself, got %v", err)
+	}
+}
+
+func TestRunChangeKill(t *testing.T) {
+	providerTerraform, _, _ := newBackendTest(t)
+	t.Setenv("FAKE_TERRAFORM_IGNORE_INTERRUPT", "1")
+
+	grace := ShutdownGrace
+	ShutdownGrace = 200 * time.Millisecond
+	defer func() { ShutdownGrace = grace }()
+
+	err, took := interruptApply(t, providerTerraform)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the apply to be cancelled, got %v", err)
+	}
+	if took < ShutdownGrace || took > 10*time.Second {
+		t.Errorf("expected terraform to be killed after the grace period, took %s", took)
+	}
+
+	_, err = os.Stat(filepath.Join(providerTerraform.WorkingDir, "interrupted"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected terraform to be killed before stopping by itself, got %v", err)
+	}
+}
+
+func TestRunChangeRetry(t *testing.T) {
+	baseDelay := retry.BaseDelay
+	retry.BaseDelay = time.Millisecond
+	defer func() { retry.BaseDelay = baseDelay }()
+
+	for _, test := range []struct {
+		message  string
+		failures int
+		runs     int
+		fails    bool
+	}{
+		{message: "Error: 503 Service Unavailable", failures: 2, runs: 3},
+		{message: "Error: dial tcp 10.0.0.1:8006: connect: connection refused", failures: 5, runs: 3, fails: true},
+		{message: "Error: Error acquiring the state lock", failures: 1, runs: 1, fails: true},
+		{message: "Error: clone failed: can't lock file '/var/lock/qemu-server/lock-200.conf' - got timeout", failures: 1, runs: 1, fails: true},
+	} {
+		providerTerraform, _, _ := newBackendTest(t)
+		providerTerraform.Config.RetryAttempts = 3
+		providerTerraform.Config.RetryTimeout = time.Minute
+		t.Setenv("FAKE_TERRAFORM_ERROR", test.message)
+		t.Setenv("FAKE_TERRAFORM_FAILURES", strconv.Itoa(test.failures))
+
+		err := runChange(context.Background(), providerTerraform, "apply")
+		if test.fails && (err == nil || !strings.Contains(err.Error(), test.message)) {
+			t.Errorf("%s: expected the error to be returned, got %v", test.message, err)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s: %v", test.message, err)
+		}
+
+		runs, _ := os.ReadFile(filepath.Join(providerTerraform.WorkingDir, "runs"))
+		if len(runs) != test.runs {
+			t.Errorf("%s: expected %d runs, got %d", test.message, test.runs, len(runs))
+		}
+	}
+}
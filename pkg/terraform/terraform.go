@@ -22,25 +22,26 @@ limitations under the License.
 package terraform
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/loft-sh/devpod/pkg/client"
-	"github.com/loft-sh/devpod/pkg/config"
 	"github.com/loft-sh/devpod/pkg/log"
-	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/connection"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/ippool"
 	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/proxmox"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/retry"
 	"github.com/pkg/errors"
 
-	"github.com/hashicorp/go-version"
-	"github.com/hashicorp/hc-install/product"
-	"github.com/hashicorp/hc-install/releases"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 
 	cp "github.com/otiai10/copy"
 )
@@ -51,14 +52,20 @@ func NewProvider(logs log.Logger) (*TerraformProvider, error) {
 		return nil, err
 	}
 
-	devpodPath, err := config.GetConfigDir()
+	binary, err := BinaryFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	terraformPath := devpodPath + "/bin/terraform"
+	// empty uses the project built into the binary
+	project := os.Getenv(options.TERRAFORM_PROJECT)
 
-	project, err := options.FromEnvOrError(options.TERRAFORM_PROJECT)
+	err = proxmox.ResolveVmId(providerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ippool.Resolve(providerConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -67,41 +74,81 @@ func NewProvider(logs log.Logger) (*TerraformProvider, error) {
 	provider := &TerraformProvider{
 		Config:     providerConfig,
 		Log:        logs,
-		Bin:        terraformPath,
+		Bin:        binary.Path,
+		Binary:     binary,
 		Project:    project,
-		State:      providerConfig.MachineFolder + "/main.tfstate",
+		State:      providerConfig.MachineFolder + "/" + localStateName,
 		WorkingDir: providerConfig.MachineFolder + "/.terraform",
+		Client: proxmox.NewClient(
+			providerConfig.ProxmoxApiUrl,
+			providerConfig.ProxmoxApiTokenId,
+			providerConfig.ProxmoxApiTokenSecret,
+			providerConfig.ProxmoxTlsInsecure,
+		),
+	}
+	provider.Client.Retry = retry.Policy{
+		Attempts: providerConfig.RetryAttempts,
+		Timeout:  providerConfig.RetryTimeout,
+	}
+	provider.Client.Log = logs
+
+	// remote backends keep the state themselves, terraform only accepts
+	// a state file for the local one
+	if isRemoteBackend(providerConfig) {
+		provider.State = ""
 	}
 
 	return provider, nil
 }
 
+// localStateName is the state file in the machine folder used without a
+// remote backend
+const localStateName = "main.tfstate"
+
 type TerraformProvider struct {
 	Config     *options.Options
 	Log        log.Logger
 	Bin        string
+	Binary     *Binary
 	Project    string
 	State      string
 	WorkingDir string
+	Client     *proxmox.Client
 }
 
-func EnsureProject(providerTerraform *TerraformProvider) error {
-	// if project is already in place, exit
-	_, err := os.Stat(providerTerraform.Config.MachineFolder + "/.terraform")
+func EnsureProject(ctx context.Context, providerTerraform *TerraformProvider) error {
+	workingDir := providerTerraform.Config.MachineFolder + "/.terraform"
+
+	// if project is already in place, only update it when asked to
+	_, err := os.Stat(workingDir)
 	if err == nil {
+		return updateProject(ctx, providerTerraform, false)
+	}
+
+	// without a project use the one built into the binary
+	if providerTerraform.Project == "" {
+		err = writeEmbeddedProject(providerTerraform, workingDir)
+		if err != nil {
+			_ = os.RemoveAll(workingDir)
+			return err
+		}
+
 		return nil
 	}
 
-	// if project is an url, try to clone it
-	if strings.Contains(providerTerraform.Project, "http://") ||
-		strings.Contains(providerTerraform.Project, "https://") {
-		cmd := exec.Command(
-			"git",
-			"clone",
-			providerTerraform.Project,
-			providerTerraform.Config.MachineFolder+"/.terraform",
-		)
-		return cmd.Run()
+	// if project is a git source, check it out
+	source, ok, err := ParseProjectSource(providerTerraform.Project)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = checkoutProject(ctx, providerTerraform, source, workingDir)
+		if err != nil {
+			_ = os.RemoveAll(workingDir)
+			return err
+		}
+
+		return nil
 	}
 
 	// else we have a path, let's copy it to destination
@@ -110,8 +157,7 @@ func EnsureProject(providerTerraform *TerraformProvider) error {
 		return errors.Errorf("terraform project not found")
 	}
 
-	err = cp.Copy(providerTerraform.Project,
-		providerTerraform.Config.MachineFolder+"/.terraform")
+	err = cp.Copy(providerTerraform.Project, workingDir)
 	if err != nil {
 		return err
 	}
@@ -119,155 +165,415 @@ func EnsureProject(providerTerraform *TerraformProvider) error {
 	return nil
 }
 
-func Init(providerTerraform *TerraformProvider) (*tfexec.Terraform, error) {
-	err := EnsureProject(providerTerraform)
+// Init prepares the working directory of the machine. terraform init only
+// runs when the project changed since the last run, providers are only
+// upgraded if TERRAFORM_UPGRADE is set.
+func Init(ctx context.Context, providerTerraform *TerraformProvider) (*tfexec.Terraform, error) {
+	return initialize(ctx, providerTerraform, providerTerraform.Config.TerraformUpgrade)
+}
+
+// Upgrade checks out the git project of the machine again, following
+// moved branches, and runs terraform init -upgrade, moving the providers
+// to the newest versions the project allows
+func Upgrade(ctx context.Context, providerTerraform *TerraformProvider) error {
+	_, err := os.Stat(providerTerraform.Config.MachineFolder + "/.terraform")
+	if err == nil {
+		err = updateProject(ctx, providerTerraform, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = initialize(ctx, providerTerraform, true)
+	return err
+}
+
+func initialize(ctx context.Context, providerTerraform *TerraformProvider, upgrade bool) (*tfexec.Terraform, error) {
+	err := EnsureProject(ctx, providerTerraform)
 	if err != nil {
 		return nil, err
 	}
 
+	// the version may have changed since the provider was initialized
+	_, err = os.Stat(providerTerraform.Bin)
+	if os.IsNotExist(err) {
+		err = Install(ctx, providerTerraform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	workingDir := providerTerraform.Config.MachineFolder + "/.terraform"
 	tf, err := tfexec.NewTerraform(workingDir, providerTerraform.Bin)
 	if err != nil {
 		return nil, err
 	}
 
-	err = tf.Init(context.Background(), tfexec.Upgrade(true))
+	err = setupEnv(providerTerraform, tf)
 	if err != nil {
 		return nil, err
 	}
 
-	return tf, nil
-}
+	err = writeBackendOverride(providerTerraform.Config, workingDir)
+	if err != nil {
+		return nil, err
+	}
 
-func Install(providerTerraform *TerraformProvider) error {
-	err := exec.Command(providerTerraform.Bin).Run()
-	if err == nil {
-		return nil
+	if !upgrade {
+		initialized, err := isInitialized(workingDir)
+		if err != nil {
+			providerTerraform.Log.Debugf("Couldn't check whether terraform is initialized: %v", err)
+		}
+		if initialized {
+			return tf, migrateState(ctx, providerTerraform, tf)
+		}
+	}
+
+	cacheLock, err := lockPluginCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cacheLock.Release()
+
+	// the state is migrated by migrateState, not by terraform, as the
+	// local state lives outside of the working dir
+	err = tf.Init(ctx, tfexec.Upgrade(upgrade), tfexec.Reconfigure(true))
+	if err != nil {
+		return nil, err
 	}
 
-	destPath := filepath.Dir(providerTerraform.Bin)
+	err = writeInitStamp(workingDir)
+	if err != nil {
+		return nil, err
+	}
 
-	err = os.MkdirAll(destPath, os.ModePerm)
+	return tf, migrateState(ctx, providerTerraform, tf)
+}
+
+func Delete(ctx context.Context, providerTerraform *TerraformProvider) error {
+	// the project is only applied once the id and address are allocated,
+	// and its variables don't validate without them
+	if !allocated(providerTerraform.Config) {
+		providerTerraform.Log.Debugf("The machine was never applied, skipping terraform destroy")
+		return release(ctx, providerTerraform)
+	}
+
+	_, err := Init(ctx, providerTerraform)
 	if err != nil {
 		return err
 	}
 
-	installer := &releases.ExactVersion{
-		InstallDir: destPath,
-		Product:    product.Terraform,
-		Version:    version.Must(version.NewVersion("1.4.0")),
+	// the variables are validated on destroy as well
+	varFile, err := writeVarFile(providerTerraform, "running")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(varFile)
 
-	_, err = installer.Install(context.Background())
+	args := []string{"destroy", "-auto-approve", "-refresh=true", "-parallelism=99"}
+	err = runChange(ctx, providerTerraform, append(args, stateArgs(providerTerraform, varFile)...)...)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return release(ctx, providerTerraform)
+}
+
+// allocated tells if the VMID and the address of the machine are known,
+// i.e. neither is still waiting for auto or pool to be resolved
+func allocated(config *options.Options) bool {
+	return config.ProxmoxVmId != options.PROXMOX_VM_ID_AUTO && config.CloudinitIp != options.CLOUDINIT_IP_POOL
 }
 
-func Delete(providerTerraform *TerraformProvider) error {
-	tf, err := Init(providerTerraform)
+// release gives the address and id of a destroyed machine back and
+// forgets how to reach it
+func release(ctx context.Context, providerTerraform *TerraformProvider) error {
+	err := connection.Remove(providerTerraform.Config.MachineFolder)
 	if err != nil {
 		return err
 	}
 
-	err = tf.Destroy(context.Background(),
-		tfexec.Lock(false),
-		tfexec.Refresh(true),
-		tfexec.Parallelism(99),
-		tfexec.State(providerTerraform.State),
+	err = ippool.Release(ctx, providerTerraform.Config)
+	if err != nil {
+		return err
+	}
+
+	return proxmox.ReleaseVmId(ctx, providerTerraform.Config)
+}
+
+func Command(ctx context.Context, providerTerraform *TerraformProvider, command string) error {
+	return proxmox.RunCommand(
+		ctx,
+		providerTerraform.Client,
+		providerTerraform.Config,
+		command,
+		func() error {
+			settings, err := connection.SettingsFromOptions(providerTerraform.Config)
+			if err != nil {
+				return err
+			}
+
+			return connection.Command(
+				ctx,
+				providerTerraform.Config.MachineFolder,
+				settings,
+				func() (*connection.Record, error) {
+					return resolveConnection(ctx, providerTerraform)
+				},
+				command,
+				providerTerraform.Log,
+			)
+		},
+		func() (string, int, error) {
+			return commandVM(ctx, providerTerraform)
+		},
+		providerTerraform.Log,
 	)
+}
+
+// commandVM looks up the VM for the guest agent, from the stored
+// connection if there is one as terraform may be what is broken
+func commandVM(ctx context.Context, providerTerraform *TerraformProvider) (string, int, error) {
+	record, err := connection.Load(providerTerraform.Config.MachineFolder)
+	if err == nil && record != nil && record.VmId != 0 {
+		return record.Node, record.VmId, nil
+	}
+
+	node, vmId, ok, err := getVM(ctx, providerTerraform)
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok {
+		return "", 0, fmt.Errorf("instance %s-devbox not found in state", providerTerraform.Config.CloudinitUsername)
+	}
+
+	return node, vmId, nil
+}
+
+// Console attaches stdin and stdout to the serial console of the VM
+func Console(
+	ctx context.Context,
+	providerTerraform *TerraformProvider,
+	stdin io.Reader,
+	stdout io.Writer,
+	cols int,
+	rows int,
+) error {
+	node, vmId, err := commandVM(ctx, providerTerraform)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return proxmox.AttachConsole(ctx, providerTerraform.Client, node, vmId, stdin, stdout, cols, rows)
 }
 
-func Command(providerTerraform *TerraformProvider, command string) error {
-	// get private key
-	privateKey, err := ssh.GetPrivateKeyRawBase(providerTerraform.Config.MachineFolder)
+// Rekey pins the host keys of a rebuilt VM in place of the old ones
+func Rekey(ctx context.Context, providerTerraform *TerraformProvider) error {
+	record, err := connection.Refresh(providerTerraform.Config.MachineFolder, func() (*connection.Record, error) {
+		return resolveConnection(ctx, providerTerraform)
+	})
+	if err != nil {
+		return err
+	}
+
+	settings, err := connection.SettingsFromOptions(providerTerraform.Config)
+	if err != nil {
+		return err
+	}
 
+	return connection.Rekey(
+		ctx,
+		providerTerraform.Config.MachineFolder,
+		record,
+		settings,
+		proxmox.HostKeySource(providerTerraform.Client),
+		providerTerraform.Log,
+	)
+}
+
+// resolveConnection asks terraform and, with dhcp, the guest agent how to
+// reach the machine
+func resolveConnection(ctx context.Context, providerTerraform *TerraformProvider) (*connection.Record, error) {
+	outputs, err := getOutputs(ctx, providerTerraform)
 	if err != nil {
-		return fmt.Errorf("load private key: %w", err)
+		return nil, err
 	}
 
 	// get external address
-	externalIP, err := getExternalIP(providerTerraform)
+	externalIP, err := outputString(outputs, "public_ip")
 	if err != nil || externalIP == "" {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"instance %s-devbox doesn't have an external nat ip",
 			providerTerraform.Config.CloudinitUsername,
 		)
 	}
 
+	node, vmId, ok, err := getVM(ctx, providerTerraform)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("instance %s-devbox not found in state", providerTerraform.Config.CloudinitUsername)
+	}
+
+	// with dhcp only the guest agent knows the address
+	if externalIP == options.CLOUDINIT_IP_DHCP {
+		externalIP, err = proxmox.GuestAddress(
+			ctx,
+			providerTerraform.Client,
+			providerTerraform.Config,
+			node,
+			vmId,
+			providerTerraform.Log,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// external ip is in cidr notation, we need to get the ip
 	externalIP = strings.Split(externalIP, "/")[0]
 
-	sshClient, err := ssh.NewSSHClient(providerTerraform.Config.CloudinitUsername, externalIP+":22", privateKey)
+	// the options take precedence over what the project declares
+	sshUser, err := outputString(outputs, "ssh_user")
+	if err != nil {
+		return nil, err
+	}
+	if providerTerraform.Config.SshUser != "" || sshUser == "" {
+		sshUser = proxmox.SshUser(providerTerraform.Config)
+	}
 
+	sshPort, err := outputPort(outputs, "ssh_port")
 	if err != nil {
-		return errors.Wrap(err, "create ssh client")
+		return nil, err
+	}
+	if providerTerraform.Config.SshPort != 0 || sshPort == 0 {
+		sshPort = proxmox.SshPort(providerTerraform.Config)
 	}
 
-	defer sshClient.Close()
+	return &connection.Record{
+		Host: externalIP,
+		Port: sshPort,
+		User: sshUser,
+		VmId: vmId,
+		Node: node,
+	}, nil
+}
 
-	// run command
-	return ssh.Run(context.Background(), sshClient, command, os.Stdin, os.Stdout, os.Stderr)
+// refreshConnection stores how to reach the machine for later commands
+func refreshConnection(ctx context.Context, providerTerraform *TerraformProvider) error {
+	_, err := connection.Refresh(providerTerraform.Config.MachineFolder, func() (*connection.Record, error) {
+		return resolveConnection(ctx, providerTerraform)
+	})
+	return err
 }
 
-func Create(providerTerraform *TerraformProvider) error {
-	tf, err := Init(providerTerraform)
+func Create(ctx context.Context, providerTerraform *TerraformProvider) error {
+	err := proxmox.AcquireVmId(
+		ctx,
+		providerTerraform.Client,
+		providerTerraform.Config,
+		providerTerraform.Log,
+	)
 	if err != nil {
 		return err
 	}
 
-	publicKeyBase, err := ssh.GetPublicKeyBase(providerTerraform.Config.MachineFolder)
+	err = ippool.Acquire(ctx, providerTerraform.Config, func() ([]string, error) {
+		vmId, _ := strconv.Atoi(providerTerraform.Config.ProxmoxVmId)
+		return providerTerraform.Client.ConfiguredAddresses(ctx, vmId)
+	}, providerTerraform.Log)
 	if err != nil {
 		return err
 	}
 
-	publicKey, err := base64.StdEncoding.DecodeString(publicKeyBase)
+	_, err = Init(ctx, providerTerraform)
 	if err != nil {
 		return err
 	}
 
-	err = tf.Apply(context.Background(),
-		tfexec.Lock(false),
-		tfexec.Refresh(true),
-		tfexec.Parallelism(99),
-		tfexec.State(providerTerraform.State),
-		tfexec.Var("node_name="+providerTerraform.Config.NodeName),
-		tfexec.Var("pm_api_url="+providerTerraform.Config.ProxmoxApiUrl),
-		tfexec.Var("pm_api_token_id="+providerTerraform.Config.ProxmoxApiTokenId),
-		tfexec.Var("pm_api_token_secret="+providerTerraform.Config.ProxmoxApiTokenSecret),
-		tfexec.Var("proxmox_vm_id="+providerTerraform.Config.ProxmoxVmId),
-		tfexec.Var("devpod_ssh_key="+string(publicKey)),
-		tfexec.Var("ssh_key="+providerTerraform.Config.CloudinitSshKey),
-		tfexec.Var("ci_user="+providerTerraform.Config.CloudinitUsername),
-		tfexec.Var("ci_password="+providerTerraform.Config.CloudinitPassword),
-		tfexec.Var("ci_ip="+providerTerraform.Config.CloudinitIp),
-		tfexec.Var("ci_gateway="+providerTerraform.Config.CloudinitGateway),
-	)
+	varFile, err := writeVarFile(providerTerraform, "running")
 	if err != nil {
 		return err
 	}
-	err = tf.Refresh(context.Background(),
-		tfexec.Lock(false),
-		tfexec.State(providerTerraform.State),
-		tfexec.Var("node_name="+providerTerraform.Config.NodeName),
-		tfexec.Var("pm_api_url="+providerTerraform.Config.ProxmoxApiUrl),
-		tfexec.Var("pm_api_token_id="+providerTerraform.Config.ProxmoxApiTokenId),
-		tfexec.Var("pm_api_token_secret="+providerTerraform.Config.ProxmoxApiTokenSecret),
-		tfexec.Var("proxmox_vm_id="+providerTerraform.Config.ProxmoxVmId),
-		tfexec.Var("devpod_ssh_key="+string(publicKey)),
-		tfexec.Var("ssh_key="+providerTerraform.Config.CloudinitSshKey),
-		tfexec.Var("ci_user="+providerTerraform.Config.CloudinitUsername),
-		tfexec.Var("ci_password="+providerTerraform.Config.CloudinitPassword),
-		tfexec.Var("ci_ip="+providerTerraform.Config.CloudinitIp),
-		tfexec.Var("ci_gateway="+providerTerraform.Config.CloudinitGateway),
+	defer os.Remove(varFile)
+
+	args := []string{"apply", "-auto-approve", "-refresh=true", "-parallelism=99"}
+	err = runChange(ctx, providerTerraform, append(args, stateArgs(providerTerraform, varFile)...)...)
+	if err != nil {
+		return err
+	}
+	err = runChange(ctx, providerTerraform, append([]string{"refresh"}, stateArgs(providerTerraform, varFile)...)...)
+	if err != nil {
+		return err
+	}
+
+	err = refreshConnection(ctx, providerTerraform)
+	if err != nil {
+		return err
+	}
+
+	settings, err := connection.SettingsFromOptions(providerTerraform.Config)
+	if err != nil {
+		return err
+	}
+
+	// the first command of DevPod would race the boot otherwise
+	return connection.WaitForReady(
+		ctx,
+		providerTerraform.Config.MachineFolder,
+		settings,
+		providerTerraform.Config.ReadyTimeout,
+		proxmox.HostKeySource(providerTerraform.Client),
+		providerTerraform.Log,
 	)
+}
+
+func Start(ctx context.Context, providerTerraform *TerraformProvider) error {
+	node, vmId, ok, err := getVM(ctx, providerTerraform)
+	if err != nil {
+		return err
+	}
+
+	// terraform sees a paused VM as running, so resume it through the api
+	if ok {
+		resumed, err := proxmox.ResumeIfPaused(ctx, providerTerraform.Client, node, vmId)
+		if err != nil && !proxmox.IsNotFound(err) {
+			return err
+		}
+		if resumed {
+			return refreshConnection(ctx, providerTerraform)
+		}
+	}
+
+	err = setState(ctx, providerTerraform, "running")
+	if err != nil {
+		return err
+	}
+
+	return refreshConnection(ctx, providerTerraform)
+}
+
+func Stop(ctx context.Context, providerTerraform *TerraformProvider) error {
+	return setState(ctx, providerTerraform, "stopped")
+}
+
+// setState applies the project with the given power state, leaving the
+// rest of the VM untouched
+func setState(ctx context.Context, providerTerraform *TerraformProvider, state string) error {
+	_, err := Init(ctx, providerTerraform)
+	if err != nil {
+		return err
+	}
+
+	varFile, err := writeVarFile(providerTerraform, state)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(varFile)
+
+	args := []string{"apply", "-auto-approve", "-refresh=true", "-parallelism=99"}
+	err = runChange(ctx, providerTerraform, append(args, stateArgs(providerTerraform, varFile)...)...)
 	if err != nil {
 		return err
 	}
@@ -275,74 +581,127 @@ func Create(providerTerraform *TerraformProvider) error {
 	return nil
 }
 
-func getExternalIP(providerTerraform *TerraformProvider) (string, error) {
-	tf, err := Init(providerTerraform)
+// getOutputs returns the outputs of the project
+func getOutputs(ctx context.Context, providerTerraform *TerraformProvider) (map[string]tfexec.OutputMeta, error) {
+	tf, err := Init(ctx, providerTerraform)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	output, err := tf.Output(context.Background(),
+	return tf.Output(ctx,
 		tfexec.State(providerTerraform.State),
 	)
-	if err != nil {
-		return "", err
+}
+
+// outputString returns a string output, empty if the project doesn't
+// declare it
+func outputString(outputs map[string]tfexec.OutputMeta, name string) (string, error) {
+	if outputs[name].Value == nil {
+		return "", nil
 	}
 
-	if output["public_ip"].Value == nil {
-		return "", errors.Errorf("output not found")
+	var value string
+	err := json.Unmarshal(outputs[name].Value, &value)
+	if err != nil {
+		return "", errors.Wrapf(err, "output %s must be a string", name)
 	}
 
-	return strings.ReplaceAll(string(output["public_ip"].Value), "\"", ""), nil
+	return value, nil
 }
 
-func Status(providerTerraform *TerraformProvider) (client.Status, error) {
-	tf, err := Init(providerTerraform)
+// outputPort returns a port number output, 0 if the project doesn't
+// declare it
+func outputPort(outputs map[string]tfexec.OutputMeta, name string) (int, error) {
+	if outputs[name].Value == nil {
+		return 0, nil
+	}
+
+	var value json.Number
+	err := json.Unmarshal(bytes.Trim(outputs[name].Value, "\""), &value)
 	if err != nil {
-		return client.StatusNotFound, err
+		return 0, errors.Wrapf(err, "output %s must be a port number", name)
+	}
+
+	port, err := strconv.Atoi(value.String())
+	if err != nil || port < 1 || port > 65535 {
+		return 0, errors.Errorf("output %s must be a port number, got %s", name, value)
 	}
 
-	publicKeyBase, err := ssh.GetPublicKeyBase(providerTerraform.Config.MachineFolder)
+	return port, nil
+}
+
+func Status(ctx context.Context, providerTerraform *TerraformProvider) (client.Status, error) {
+	node, vmId, ok, err := getVM(ctx, providerTerraform)
 	if err != nil {
 		return client.StatusNotFound, err
 	}
+	if !ok {
+		return client.StatusNotFound, nil
+	}
 
-	publicKey, err := base64.StdEncoding.DecodeString(publicKeyBase)
+	// the state only knows what was last applied, ask proxmox what the VM
+	// is doing right now
+	status, err := providerTerraform.Client.GetVMStatus(ctx, node, vmId)
 	if err != nil {
+		if proxmox.IsNotFound(err) {
+			return client.StatusNotFound, nil
+		}
+
 		return client.StatusNotFound, err
 	}
-	err = tf.Refresh(context.Background(),
-		tfexec.Lock(false),
-		tfexec.State(providerTerraform.State),
-		tfexec.Var("node_name="+providerTerraform.Config.NodeName),
-		tfexec.Var("pm_api_url="+providerTerraform.Config.ProxmoxApiUrl),
-		tfexec.Var("pm_api_token_id="+providerTerraform.Config.ProxmoxApiTokenId),
-		tfexec.Var("pm_api_token_secret="+providerTerraform.Config.ProxmoxApiTokenSecret),
-		tfexec.Var("proxmox_vm_id="+providerTerraform.Config.ProxmoxVmId),
-		tfexec.Var("devpod_ssh_key="+string(publicKey)),
-		tfexec.Var("ssh_key="+providerTerraform.Config.CloudinitSshKey),
-		tfexec.Var("ci_user="+providerTerraform.Config.CloudinitUsername),
-		tfexec.Var("ci_password="+providerTerraform.Config.CloudinitPassword),
-		tfexec.Var("ci_ip="+providerTerraform.Config.CloudinitIp),
-		tfexec.Var("ci_gateway="+providerTerraform.Config.CloudinitGateway),
-	)
+
+	return proxmox.StatusFromVM(status), nil
+}
+
+// getVM returns the node and id of the VM recorded in the state of the
+// machine, ok is false if nothing was applied yet
+func getVM(ctx context.Context, providerTerraform *TerraformProvider) (string, int, bool, error) {
+	if providerTerraform.State != "" {
+		_, err := os.Stat(providerTerraform.State)
+		if os.IsNotExist(err) {
+			return "", 0, false, nil
+		}
+	}
+
+	tf, err := Init(ctx, providerTerraform)
 	if err != nil {
-		return client.StatusNotFound, err
+		return "", 0, false, err
 	}
 
-	state, err := tf.ShowStateFile(
-		context.Background(),
-		providerTerraform.State,
-	)
+	var state *tfjson.State
+	if providerTerraform.State != "" {
+		state, err = tf.ShowStateFile(ctx, providerTerraform.State)
+	} else {
+		state, err = tf.Show(ctx)
+	}
 	if err != nil {
-		return client.StatusNotFound, err
+		return "", 0, false, err
 	}
 
-	if state.Values == nil {
-		return client.StatusNotFound, nil
+	node, vmId, ok := vmFromState(state)
+	return node, vmId, ok, nil
+}
+
+// vmFromState returns the node and id of the VM resource in the state, if
+// there is one
+func vmFromState(state *tfjson.State) (string, int, bool) {
+	if state.Values == nil || state.Values.RootModule == nil {
+		return "", 0, false
 	}
-	if state.Values.Outputs != nil {
-		return client.StatusRunning, nil
+
+	for _, resource := range state.Values.RootModule.Resources {
+		if resource.Type != "proxmox_vm_qemu" {
+			continue
+		}
+
+		node, _ := resource.AttributeValues["target_node"].(string)
+		vmId, _ := resource.AttributeValues["vmid"].(float64)
+		if node == "" || vmId <= 0 {
+			return "", 0, false
+		}
+
+		return node, int(vmId), true
 	}
 
-	return client.StatusBusy, nil
+	return "", 0, false
 }
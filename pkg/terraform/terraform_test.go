@@ -0,0 +1,70 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"context"
+	"testing"
+
+	"github.com/loft-sh/devpod/pkg/log"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/ippool"
+	"github.com/pisomind/devpod-provider-proxmox/pkg/options"
+)
+
+// TestDeleteUnallocated checks that machines whose create failed before
+// the project was applied are deleted without running terraform, which
+// the provider here has no binary or project for
+func TestDeleteUnallocated(t *testing.T) {
+	t.Setenv("DEVPOD_HOME", t.TempDir())
+	ctx := context.Background()
+
+	// the address was leased but no VMID allocated
+	config := &options.Options{
+		MachineID:        "devpod-test",
+		MachineFolder:    t.TempDir(),
+		ProxmoxVmId:      options.PROXMOX_VM_ID_AUTO,
+		CloudinitIp:      options.CLOUDINIT_IP_POOL,
+		CloudinitGateway: "192.168.1.1",
+		IpPool:           "192.168.1.10-192.168.1.20/24",
+	}
+	err := ippool.Acquire(ctx, config, func() ([]string, error) { return nil, nil }, log.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Delete(ctx, &TerraformProvider{Config: config, Log: log.Default})
+	if err != nil {
+		t.Fatalf("expected the delete to skip terraform, got %v", err)
+	}
+	lease, err := ippool.LoadLease(config.MachineFolder)
+	if err != nil || lease != nil {
+		t.Fatalf("expected the lease to be released, got %v, %v", lease, err)
+	}
+
+	// a fixed VMID but the pool never got to lease an address
+	config = &options.Options{
+		MachineID:     "devpod-test",
+		MachineFolder: t.TempDir(),
+		ProxmoxVmId:   "9000",
+		CloudinitIp:   options.CLOUDINIT_IP_POOL,
+		IpPool:        "192.168.1.10-192.168.1.20/24",
+	}
+	err = Delete(ctx, &TerraformProvider{Config: config, Log: log.Default})
+	if err != nil {
+		t.Fatalf("expected the delete to skip terraform, got %v", err)
+	}
+}
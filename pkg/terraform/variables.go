@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Pisomind Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package terraform
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/loft-sh/devpod/pkg/ssh"
+)
+
+const varFileName = "devpod.tfvars.json"
+
+// Variables returns the values of the project variables for the machine,
+// with the VM in the given power state
+func Variables(providerTerraform *TerraformProvider, state string) (map[string]string, error) {
+	publicKeyBase, err := ssh.GetPublicKeyBase(providerTerraform.Config.MachineFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(publicKeyBase)
+	if err != nil {
+		return nil, err
+	}
+
+	config := providerTerraform.Config
+	return map[string]string{
+		"state":                 state,
+		"node_name":             config.NodeName,
+		"pm_api_url":            config.ProxmoxApiUrl,
+		"pm_api_token_id":       config.ProxmoxApiTokenId,
+		"pm_api_token_secret":   config.ProxmoxApiTokenSecret,
+		"pm_tls_insecure":       strconv.FormatBool(config.ProxmoxTlsInsecure),
+		"proxmox_vm_id":         config.ProxmoxVmId,
+		"proxmox_template_name": config.TemplateName,
+		"devpod_ssh_key":        string(publicKey),
+		"ssh_key":               config.CloudinitSshKey,
+		"ci_user":               config.CloudinitUsername,
+		"ci_password":           config.CloudinitPassword,
+		"ci_ip":                 config.CloudinitIp,
+		"ci_gateway":            config.CloudinitGateway,
+		"cores":                 config.VmCores,
+		"memory":                config.VmMemory,
+		"disk_size":             config.DiskSize,
+		"disk_storage":          config.DiskStorage,
+		"network_bridge":        config.NetworkBridge,
+		"vlan_tag":              vlanTag(config.VlanTag),
+	}, nil
+}
+
+// vlanTag returns the tag as the project expects it, 0 meaning untagged
+func vlanTag(tag string) string {
+	if tag == "" {
+		return "0"
+	}
+
+	return tag
+}
+
+// writeVarFile writes the variables into a tfvars file in the machine
+// folder that only the current user can read, so secrets never show up
+// in the arguments of the terraform process. The caller removes the file
+// once terraform is done.
+func writeVarFile(providerTerraform *TerraformProvider, state string) (string, error) {
+	variables, err := Variables(providerTerraform, state)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(variables)
+	if err != nil {
+		return "", err
+	}
+
+	// recreate the file so a stale one with wider permissions is not reused
+	path := filepath.Join(providerTerraform.Config.MachineFolder, varFileName)
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}